@@ -0,0 +1,49 @@
+package gluaflag
+
+import (
+	"os"
+
+	"github.com/yuin/gopher-lua"
+)
+
+const (
+	ansiBold  = "\x1b[1m"
+	ansiDim   = "\x1b[2m"
+	ansiReset = "\x1b[0m"
+)
+
+// SetColor enables ANSI colors in the usage, flag names are printed bold and
+// types dimmed. Colors are left out when the output is a file that is not a
+// terminal or when the NO_COLOR environment variable is set.
+func (fs *FlagSet) SetColor(b bool) {
+	fs.color = b
+}
+
+func color(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetColor(L.OptBool(2, true))
+	return 0
+}
+
+// colorEnabled reports whether the usage should be colored
+func (fs *FlagSet) colorEnabled() bool {
+	if !fs.color {
+		return false
+	}
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	if f, ok := fs.output.(*os.File); ok {
+		info, err := f.Stat()
+		return err == nil && info.Mode()&os.ModeCharDevice != 0
+	}
+	return true
+}
+
+// paint wraps s in the ANSI code if colors are enabled
+func (fs *FlagSet) paint(code, s string) string {
+	if s == "" || !fs.colorEnabled() {
+		return s
+	}
+	return code + s + ansiReset
+}
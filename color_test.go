@@ -0,0 +1,68 @@
+package gluaflag
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestColorUsage(t *testing.T) {
+	// restore NO_COLOR after the test, color is disabled while it is set
+	t.Setenv("NO_COLOR", "")
+	os.Unsetenv("NO_COLOR")
+
+	src := `
+	local flag = require('flag')
+	fs = flag.new("cmd")
+	fs:string("name", "", "Name", {alias="n"})
+	fs:bool("v", false, "Verbose")
+	fs:setOutput(function(s) end)
+
+	print(fs:usage())
+	fs:color()
+	print(fs:usage())
+	`
+
+	expected := strings.Join([]string{
+		"usage: cmd [options]",
+		"  -name, -n string",
+		"    \tName",
+		"  -v\tVerbose",
+		"",
+		"usage: cmd [options]",
+		"  \x1b[1m-name\x1b[0m, \x1b[1m-n\x1b[0m \x1b[2mstring\x1b[0m",
+		"    \tName",
+		"  \x1b[1m-v\x1b[0m\tVerbose",
+		"",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%q`, got: `%q`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestColorUsageDisabled(t *testing.T) {
+	t.Setenv("NO_COLOR", "1")
+
+	src := `
+	local flag = require('flag')
+	fs = flag.new("cmd")
+	fs:string("name", "", "Name")
+	fs:setOutput(function(s) end)
+	fs:color()
+	print(fs:usage())
+	`
+
+	expected := strings.Join([]string{
+		"usage: cmd [options]",
+		"  -name string",
+		"    \tName",
+		"",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%q`, got: `%q`\nsrc: `%v`", expected, got, src)
+	}
+}
@@ -0,0 +1,284 @@
+package gluaflag
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// matchPaths returns the filesystem entries starting with prefix. An empty
+// prefix lists the current directory and a prefix ending in a path separator
+// lists that directory. Directories are suffixed with a path separator. The
+// prefix "-" also matches itself, the conventional name for stdin.
+func matchPaths(prefix string, dirsOnly bool) []string {
+	dir, base := filepath.Split(prefix)
+	readDir := dir
+	if readDir == "" {
+		readDir = "."
+	}
+
+	res := []string{}
+	if prefix == "-" {
+		res = append(res, "-")
+	}
+
+	entries, err := ioutil.ReadDir(readDir)
+	if err != nil {
+		return res
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) {
+			continue
+		}
+		// hidden entries are only listed when asked for explicitly
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		if dirsOnly && !entry.IsDir() {
+			continue
+		}
+		if entry.IsDir() {
+			name += string(filepath.Separator)
+		}
+		res = append(res, dir+name)
+	}
+
+	sort.Strings(res)
+	return res
+}
+
+func files(L *lua.LState) int {
+	prefix := L.OptString(1, "")
+	L.Push(lua.LString(strings.Join(matchPaths(prefix, false), " ")))
+	return 1
+}
+
+func dirs(L *lua.LState) int {
+	prefix := L.OptString(1, "")
+	L.Push(lua.LString(strings.Join(matchPaths(prefix, true), " ")))
+	return 1
+}
+
+// matchEnvNames returns the sorted names of the environment variables
+// starting with prefix
+func matchEnvNames(prefix string) []string {
+	res := []string{}
+	for _, env := range os.Environ() {
+		name := env
+		if i := strings.Index(env, "="); i >= 0 {
+			name = env[:i]
+		}
+		// skip the hidden =C: style variables of windows
+		if name != "" && strings.HasPrefix(name, prefix) {
+			res = append(res, name)
+		}
+	}
+
+	sort.Strings(res)
+	return res
+}
+
+func envNames(L *lua.LState) int {
+	prefix := L.OptString(1, "")
+	L.Push(lua.LString(strings.Join(matchEnvNames(prefix), " ")))
+	return 1
+}
+
+// noCompletions returns the completion function of flags and arguments
+// defined without one, it returns no candidates
+func noCompletions(L *lua.LState) *lua.LFunction {
+	return L.NewFunction(func(L *lua.LState) int {
+		return 0
+	})
+}
+
+// staticCompFn returns a completion function offering the candidates that
+// start with the word to complete
+func staticCompFn(L *lua.LState, candidates []string) *lua.LFunction {
+	return L.NewFunction(func(L *lua.LState) int {
+		word := L.OptString(1, "")
+		res := []string{}
+		for _, c := range candidates {
+			if strings.HasPrefix(c, word) {
+				res = append(res, c)
+			}
+		}
+		L.Push(toTable(L, res))
+		return 1
+	})
+}
+
+// matchCompletions returns the completions starting with word
+func matchCompletions(comps []completion, word string) []completion {
+	res := []completion{}
+	for _, comp := range comps {
+		if strings.HasPrefix(comp.value, word) {
+			res = append(res, comp)
+		}
+	}
+	return res
+}
+
+// completion is a completion candidate with an optional description. The
+// prefix is the part of the word before the value, e.g. --name= when the
+// value is joined with the flag.
+type completion struct {
+	value       string
+	description string
+	prefix      string
+}
+
+func toCompletions(s []string) []completion {
+	comps := make([]completion, 0, len(s))
+	for _, v := range s {
+		comps = append(comps, completion{value: v})
+	}
+	return comps
+}
+
+// tableCompletions converts a table of strings or {value, description} pairs
+func tableCompletions(t *lua.LTable) []completion {
+	comps := []completion{}
+	t.ForEach(func(k, v lua.LValue) {
+		if key, ok := k.(lua.LNumber); !ok || int(key) < 1 {
+			return
+		}
+		pair, ok := v.(*lua.LTable)
+		if !ok {
+			comps = append(comps, completion{value: v.String()})
+			return
+		}
+
+		comp := completion{value: pair.RawGetInt(1).String()}
+		if desc := pair.RawGetInt(2); desc != lua.LNil {
+			comp.description = desc.String()
+		}
+		comps = append(comps, comp)
+	})
+	return comps
+}
+
+// formatCompletions serializes the completions for the given shell. Bash gets
+// the plain values, zsh `value:description` pairs as used by _describe and
+// fish tab separated `value\tdescription` lines. Bash splits words on = so
+// only zsh and fish get the prefix of values joined with a flag.
+func formatCompletions(comps []completion, format string) ([]string, error) {
+	res := make([]string, 0, len(comps))
+	for _, comp := range comps {
+		switch format {
+		case "bash":
+			res = append(res, comp.value)
+		case "zsh":
+			value := strings.Replace(comp.prefix+comp.value, ":", "\\:", -1)
+			if comp.description != "" {
+				value += ":" + comp.description
+			}
+			res = append(res, value)
+		case "fish":
+			value := comp.prefix + comp.value
+			if comp.description != "" {
+				value += "\t" + comp.description
+			}
+			res = append(res, value)
+		default:
+			return nil, fmt.Errorf("unknown completion format: %v", format)
+		}
+	}
+	return res, nil
+}
+
+// completionEntrypoint is the first argument the completion script invokes
+// the program with, followed by COMP_CWORD and COMP_WORDS
+const completionEntrypoint = "__compgen"
+
+var bashCompletionTemplate = `_%[1]v_complete() {
+	local IFS=$'\n'
+	COMPREPLY=($(%[2]v %[3]v "$COMP_CWORD" "${COMP_WORDS[@]}" 2>/dev/null))
+}
+complete -o default -F _%[1]v_complete %[2]v
+`
+
+var nonIdentifier = regexp.MustCompile("[^a-zA-Z0-9_]")
+
+// CompletionScript returns a bash completion script for the program. The
+// script runs `prog __compgen COMP_CWORD COMP_WORDS...` and expects the
+// program to print the result of compgen one completion per line, e.g.
+//
+//	if arg[1] == "__compgen" then
+//		local words = {[0] = arg[3], select(4, unpack(arg))}
+//		print(table.concat(fs:compgen(tonumber(arg[2]), words), "\n"))
+//	end
+func (fs *FlagSet) CompletionScript(prog string) string {
+	fn := nonIdentifier.ReplaceAllString(prog, "_")
+	return fmt.Sprintf(bashCompletionTemplate, fn, prog, completionEntrypoint)
+}
+
+func completionScript(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	prog := L.OptString(2, filepath.Base(gf.name))
+
+	L.Push(lua.LString(gf.CompletionScript(prog)))
+	return 1
+}
+
+// completionSpec returns a description of the flags, positional arguments and
+// subcommands for completers that do not call compgen. Dynamic is set for
+// flags and arguments with a completion function or candidates given.
+func (fs *FlagSet) completionSpec(L *lua.LState) *lua.LTable {
+	flags := L.NewTable()
+	for _, name := range fs.order {
+		f := fs.flags[name]
+		t := L.NewTable()
+		t.RawSetString("name", lua.LString(f.name))
+		if f.alias != "" {
+			t.RawSetString("alias", lua.LString(f.alias))
+		}
+		t.RawSetString("type", lua.LString(f.typeName()))
+		t.RawSetString("usage", lua.LString(f.usage))
+		t.RawSetString("takesValue", lua.LBool(f.takesValue()))
+		t.RawSetString("slice", lua.LBool(f.isSlice()))
+		t.RawSetString("required", lua.LBool(f.required))
+		t.RawSetString("dynamic", lua.LBool(f.dynamic))
+		if len(f.choices) > 0 {
+			t.RawSetString("choices", toTable(L, f.choices))
+		}
+		flags.Append(t)
+	}
+
+	args := L.NewTable()
+	for _, a := range fs.arguments {
+		t := L.NewTable()
+		t.RawSetString("name", lua.LString(a.name))
+		t.RawSetString("type", lua.LString(a.typ))
+		t.RawSetString("usage", lua.LString(a.usage))
+		t.RawSetString("slice", lua.LBool(a.slice))
+		t.RawSetString("dynamic", lua.LBool(a.dynamic))
+		args.Append(t)
+	}
+
+	spec := L.NewTable()
+	spec.RawSetString("flags", flags)
+	spec.RawSetString("arguments", args)
+	if len(fs.commands) > 0 {
+		commands := L.NewTable()
+		for _, name := range fs.commandNames {
+			commands.RawSetString(name, fs.commands[name].completionSpec(L))
+		}
+		spec.RawSetString("commands", commands)
+	}
+	return spec
+}
+
+func completionSpec(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	L.Push(gf.completionSpec(L))
+	return 1
+}
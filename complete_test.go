@@ -0,0 +1,541 @@
+package gluaflag
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilesAndDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gluaflag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"foo.txt", "fum.txt", "bar.txt", ".hidden", "-dash.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte{}, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "fdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	src := `
+	local flag = require('flag')
+	local dir = "` + dir + `/"
+	print(flag.files(dir .. "f"))
+	print(flag.dirs(dir))
+	print(flag.files(dir .. "missing/"))
+	print(flag.files("-"))
+	`
+
+	expected := strings.Join([]string{
+		strings.Join([]string{dir + "/fdir/", dir + "/foo.txt", dir + "/fum.txt"}, " "),
+		dir + "/fdir/",
+		"",
+		"- -dash.txt",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCompgenFormats(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("color", "", "Color", function()
+		return {{"red", "warm color"}, {"blue", "cold color"}, "a:b"}
+	end)
+
+	words = {[0] = "cmd", "-color", ""}
+	print(table.concat(fs:compgen(2, words), "|"))
+	print(table.concat(fs:compgen(2, words, "bash"), "|"))
+	print(table.concat(fs:compgen(2, words, "zsh"), "|"))
+	print(table.concat(fs:compgen(2, words, "fish"), "|"))
+	print(table.concat(fs:compgen(1, {[0] = "cmd", "-"}, "zsh"), "|"))
+	ok, err = pcall(function() fs:compgen(2, words, "csh") end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"red|blue|a:b",
+		"red|blue|a:b",
+		"red:warm color|blue:cold color|a\\:b",
+		"red\twarm color|blue\tcold color|a:b",
+		"-color:Color",
+		"<string>:14: bad argument #4 to compgen (unknown completion format: csh)",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCompgenTypedFlags(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:int("count", 0, "Count")
+	fs:bool("verbose", false, "Verbose")
+	fs:string("size", "", "Size", function(word, flags)
+		if flags.verbose then
+			return {tostring(flags.count * 2), type(flags.count)}
+		end
+		return {}
+	end)
+
+	print(table.concat(fs:compgen(5, {[0] = "cmd", "-count", "21", "-verbose", "-size", ""}), " "))
+	flags = fs:parse({[0] = "cmd"})
+	print(flags.count, flags.verbose)
+	`
+
+	expected := "42 number\n0\tfalse"
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCompgenAfterFlagValue(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("name", "", "Name", function() return {"alice", "bob"} end)
+	fs:string("dash", "", "Dash", function() return {"value"} end)
+	fs:bool("verbose", false, "Verbose")
+	fs:stringArg("file", 1, "File", function() return {"a.txt", "b.txt"} end)
+
+	print(table.concat(fs:compgen(2, {[0] = "cmd", "-name", ""}), " "))
+	print(table.concat(fs:compgen(3, {[0] = "cmd", "-name", "foo", ""}), " "))
+	print(table.concat(fs:compgen(3, {[0] = "cmd", "-name", "foo", "-"}), " "))
+	print(table.concat(fs:compgen(2, {[0] = "cmd", "-name=foo", ""}), " "))
+	print(table.concat(fs:compgen(2, {[0] = "cmd", "-verbose", ""}), " "))
+	print(table.concat(fs:compgen(3, {[0] = "cmd", "-dash", "-name", ""}), " "))
+	`
+
+	expected := strings.Join([]string{
+		"alice bob",
+		"a.txt b.txt",
+		"-dash -name -verbose",
+		"a.txt b.txt",
+		"a.txt b.txt",
+		"a.txt b.txt",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestLongFlags(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("name", "", "Name")
+	fs:bool("verbose", false, "Verbose")
+	fs:longFlags()
+
+	flags = fs:parse({[0] = "cmd", "--name", "foo", "--verbose"})
+	print(flags.name, flags.verbose)
+	fs:reset()
+	flags = fs:parse({[0] = "cmd", "--name=bar", "--", "--verbose"})
+	print(flags.name, flags.verbose, flags[1])
+	print(table.concat(fs:compgen(1, {[0] = "cmd", "--"}), " "))
+	`
+
+	expected := strings.Join([]string{
+		"foo\ttrue",
+		"bar\tfalse\t--verbose",
+		"--name --verbose",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestStaticCompletion(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("fruit", "", "Fruit", {complete={"apple", "banana", "avocado"}})
+
+	print(table.concat(fs:compgen(2, {[0] = "cmd", "-fruit", "a"}), " "))
+	print(table.concat(fs:compgen(2, {[0] = "cmd", "-fruit"}), " "))
+	`
+
+	expected := strings.Join([]string{
+		"apple avocado",
+		"apple banana avocado",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestFilterCompletions(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("name", "", "Name", function() return "foo bar baz" end)
+
+	words = {[0] = "cmd", "-name", "ba"}
+	print(table.concat(fs:compgen(2, words), "|"))
+	fs:filterCompletions()
+	print(table.concat(fs:compgen(2, words), "|"))
+	`
+
+	expected := strings.Join([]string{
+		"foo bar baz",
+		"bar|baz",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCompletionScript(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("/usr/bin/my-tool")
+	print(fs:completionScript())
+	`
+
+	expected := strings.Join([]string{
+		"_my_tool_complete() {",
+		"\tlocal IFS=$'\\n'",
+		"\tCOMPREPLY=($(my-tool __compgen \"$COMP_CWORD\" \"${COMP_WORDS[@]}\" 2>/dev/null))",
+		"}",
+		"complete -o default -F _my_tool_complete my-tool",
+		"",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestArgumentCompgenPosition(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:bool("v", false, "Verbose")
+	fs:stringArg("cmd", 1, "Command", function(word, flags, raw, i)
+		return "cmd" .. i
+	end)
+	fs:stringArg("files", "+", "Files", function(word, flags, raw, i)
+		return "file" .. i
+	end)
+
+	print(table.concat(fs:compgen(1, {[0] = "prog", ""}), " "))
+	print(table.concat(fs:compgen(2, {[0] = "prog", "-v", ""}), " "))
+	print(table.concat(fs:compgen(3, {[0] = "prog", "-v", "run", ""}), " "))
+	print(table.concat(fs:compgen(4, {[0] = "prog", "run", "a", "b"}), " "))
+	print(table.concat(fs:compgen(4, {[0] = "prog", "run", "a", "b", "c"}), " "))
+	`
+
+	expected := strings.Join([]string{
+		"cmd1",
+		"cmd1",
+		"file2",
+		"file4",
+		"file4",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCacheCompletions(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	calls = 0
+	local function branches(word)
+		calls = calls + 1
+		return {"main", "develop"}
+	end
+
+	fs = flag.new()
+	fs:stringArg("from", 1, "From", branches)
+	fs:stringArg("to", 1, "To", branches)
+	fs:cacheCompletions()
+
+	for i = 1, 3 do
+		fs:compgen(1, {[0] = "cmd"})
+		fs:compgen(2, {[0] = "cmd", "main"})
+	end
+	print(calls)
+
+	fs:compgen(2, {[0] = "cmd", "main", "d"})
+	print(calls)
+
+	fs:cacheCompletions(false)
+	fs:compgen(1, {[0] = "cmd"})
+	fs:compgen(1, {[0] = "cmd"})
+	print(calls)
+
+	local function positions(word, flags, words, position)
+		return {"p" .. position}
+	end
+	shared = flag.new()
+	shared:stringArg("files", "*", "Files", positions)
+	shared:bool("v", false, "Verbose")
+	shared:cacheCompletions()
+	print(shared:compgen(1, {[0] = "cmd", ""})[1], shared:compgen(2, {[0] = "cmd", "x", ""})[1])
+	print(shared:compgen(2, {[0] = "cmd", "-v", ""})[1])
+
+	local n = 0
+	orig = flag.new()
+	orig:stringArg("x", 1, "X", function() n = n + 1 return {"call" .. n} end)
+	orig:cacheCompletions()
+	c = orig:clone()
+	print(orig:compgen(1, {[0] = "cmd", ""})[1], c:compgen(1, {[0] = "cmd", ""})[1])
+	`
+
+	expected := strings.Join([]string{
+		"2",
+		"3",
+		"5",
+		"p1\tp2",
+		"p1",
+		"call1\tcall2",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCompletionSpec(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("branch", "", "Branch", {alias="b", compgen=function() return "main" end})
+	fs:ints("ids", "Ids")
+	fs:bool("v", false, "Verbose")
+	fs:choice("mode", "fast", {"fast", "slow"}, "Mode")
+	fs:stringArg("src", 1, "Source", function() return "a" end)
+	fs:intArg("n", "?", "Count")
+	fs:command("sub", flag.new("sub"))
+
+	spec = fs:completionSpec()
+	for _, f in ipairs(spec.flags) do
+		print(f.name, f.alias, f.type, f.takesValue, f.slice, f.dynamic, f.choices and table.concat(f.choices, ","))
+	end
+	for _, a in ipairs(spec.arguments) do
+		print(a.name, a.type, a.slice, a.dynamic)
+	end
+	print(#spec.commands.sub.flags)
+	`
+
+	expected := strings.Join([]string{
+		"branch\tb\tstring\ttrue\tfalse\ttrue\tnil",
+		"ids\tnil\tints\ttrue\ttrue\tfalse\tnil",
+		"v\tnil\tbool\tfalse\tfalse\tfalse\tnil",
+		"mode\tnil\tchoice\ttrue\tfalse\tfalse\tfast,slow",
+		"src\tstring\tfalse\ttrue",
+		"n\tint\tfalse\tfalse",
+		"0",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestSubcommandCompgen(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("tool")
+	fs:string("config", "", "Config")
+	deploy = fs:command("deploy", flag.new("deploy"))
+	deploy:string("env", "", "Env", {complete={"prod", "dev"}})
+	deploy:bool("force", false, "Force")
+	deploy:stringArg("target", 1, "Target", function() return {"web", "db"} end)
+
+	print(table.concat(fs:compgen(4, {[0] = "tool", "-config", "x", "deploy", "-"}), " "))
+	print(table.concat(fs:compgen(3, {[0] = "tool", "deploy", "-env"}), " "))
+	print(table.concat(fs:compgen(3, {[0] = "tool", "deploy", "-env", "d"}), " "))
+	print(table.concat(fs:compgen(2, {[0] = "tool", "deploy"}), " "))
+	print(table.concat(fs:compgen(3, {[0] = "tool", "deploy", "-force"}), " "))
+	`
+
+	expected := strings.Join([]string{
+		"-env -force",
+		"prod dev",
+		"dev",
+		"web db",
+		"web db",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCompgenJoinedLongFlag(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("tool")
+	fs:string("level", "", "Level", function()
+		return {{"debug", "verbose logging"}, {"info", "normal logging"}}
+	end)
+	fs:longFlags()
+	fs:filterCompletions()
+
+	for _, format in ipairs({"bash", "zsh", "fish"}) do
+		print(table.concat(fs:compgen(1, {[0] = "tool", "--level="}, format), "|"))
+	end
+	print(table.concat(fs:compgen(1, {[0] = "tool", "--level=d"}, "zsh"), "|"))
+	`
+
+	expected := strings.Join([]string{
+		"debug|info",
+		"--level=debug:verbose logging|--level=info:normal logging",
+		"--level=debug\tverbose logging|--level=info\tnormal logging",
+		"--level=debug:verbose logging",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestEnvNames(t *testing.T) {
+	os.Setenv("GLUAFLAG_TEST_HOME", "/tmp")
+	os.Setenv("GLUAFLAG_TEST_PATH", "/bin")
+	defer os.Unsetenv("GLUAFLAG_TEST_HOME")
+	defer os.Unsetenv("GLUAFLAG_TEST_PATH")
+
+	src := `
+	local flag = require('flag')
+	print(flag.envNames("GLUAFLAG_TEST_"))
+	print(flag.envNames("GLUAFLAG_TEST_H"))
+
+	fs = flag.new("tool")
+	fs:stringArg("var", 1, "Variable", function(word) return flag.envNames(word) end)
+	print(table.concat(fs:compgen(1, {[0] = "tool", "GLUAFLAG_TEST_P"}), " "))
+	`
+
+	expected := strings.Join([]string{
+		"GLUAFLAG_TEST_HOME GLUAFLAG_TEST_PATH",
+		"GLUAFLAG_TEST_HOME",
+		"GLUAFLAG_TEST_PATH",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCompgenWithoutCompFn(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("tool")
+	fs:string("name", "", "Name")
+	fs:stringArg("file", 1, "File")
+	print(#fs:compgen(2, {[0] = "tool", "-name", ""}))
+	print(#fs:compgen(1, {[0] = "tool", ""}))
+	print(#fs:compgen(1, {[0] = "tool", "x"}))
+	`
+
+	expected := strings.Join([]string{
+		"0",
+		"0",
+		"0",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCompgenSliceFlagValue(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("tool")
+	fs:strings("tag", "Tags", {compgen=function() return {"alpha", "beta"} end})
+	fs:ints("n", "Numbers", {compgen=function() return {"1", "2"} end})
+	fs:keyvalue("env", "Environment", {compgen=function() return {"HOME=", "PATH="} end})
+
+	print(table.concat(fs:compgen(2, {[0] = "tool", "-tag", ""}), " "))
+	print(table.concat(fs:compgen(4, {[0] = "tool", "-tag", "alpha", "-tag", ""}), " "))
+	print(table.concat(fs:compgen(2, {[0] = "tool", "-n", ""}), " "))
+	print(table.concat(fs:compgen(2, {[0] = "tool", "-env", ""}), " "))
+	print(table.concat(fs:compgen(1, {[0] = "tool", "-env="}), " "))
+	`
+
+	expected := strings.Join([]string{
+		"alpha beta",
+		"alpha beta",
+		"1 2",
+		"HOME= PATH=",
+		"HOME= PATH=",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestArgumentCompFnNameAndType(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	local function hosts(word, flags, words, position, name, typ)
+		if name == "port" then
+			return {"80", "443"}
+		end
+		return {name .. ":" .. typ .. ":" .. position}
+	end
+
+	fs = flag.new("tool")
+	fs:stringArg("host", 1, "Host", hosts)
+	fs:intArg("port", 1, "Port", hosts)
+	print(table.concat(fs:compgen(1, {[0] = "tool", ""}), " "))
+	print(table.concat(fs:compgen(2, {[0] = "tool", "example.org", ""}), " "))
+	`
+
+	expected := strings.Join([]string{
+		"host:string:1",
+		"80 443",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
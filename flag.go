@@ -2,7 +2,11 @@ package gluaflag
 
 import (
 	"fmt"
+	"math"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/yuin/gopher-lua"
 )
@@ -10,11 +14,33 @@ import (
 var flagFuncs = map[string]lua.LGFunction{}
 
 type flg struct {
-	name     string
-	value    interface{}
-	usage    string
-	required bool
-	compFn   *lua.LFunction
+	name       string
+	value      interface{}
+	usage      string
+	required   bool
+	alias      string
+	min        *float64
+	max        *float64
+	pattern    *regexp.Regexp
+	fromFile   bool
+	stdin      bool
+	deprecated string
+	choices    []string
+	def        interface{}
+	defaults   []string
+	split      bool
+	units      float64
+	base       *int
+	validate   *lua.LFunction
+	compFn     *lua.LFunction
+	dynamic    bool
+
+	// explicitValue lets a boolean flag take a following true or false
+	explicitValue bool
+	// appendDefaults keeps the default list of a slice flag when values are given
+	appendDefaults bool
+	// optionalValue is the value of a flag given without one
+	optionalValue *string
 }
 
 func (f *flg) userdata(L *lua.LState) lua.LValue {
@@ -24,8 +50,344 @@ func (f *flg) userdata(L *lua.LState) lua.LValue {
 	return ud
 }
 
+// typeName returns the name of the flag type as used when registering it
+func (f *flg) typeName() string {
+	switch f.value.(type) {
+	case *float64:
+		return "number"
+	case *numberslice:
+		return "numbers"
+	case *float32Value:
+		return "float32"
+	case *float32slice:
+		return "float32s"
+	case *int:
+		return "int"
+	case *intslice:
+		return "ints"
+	case *int64:
+		return "int64"
+	case *uint:
+		return "uint"
+	case *uint64:
+		return "uint64"
+	case *portValue:
+		return "port"
+	case *portslice:
+		return "ports"
+	case *string:
+		return "string"
+	case *stringslice:
+		return "strings"
+	case *bool:
+		return "bool"
+	case *boolslice:
+		return "bools"
+	case *time.Duration:
+		return "duration"
+	case *durationslice:
+		return "durations"
+	case *counter:
+		return "count"
+	case *choiceValue:
+		return "choice"
+	case *keyvalues:
+		return "keyvalue"
+	case *customValue:
+		return "custom"
+	case *jsonValue:
+		return "json"
+	}
+	return fmt.Sprintf("%T", f.value)
+}
+
+// toLValue converts the current value of the flag to the Lua value returned
+// by parse
+func (f *flg) toLValue(L *lua.LState) lua.LValue {
+	switch value := f.value.(type) {
+	case *float64:
+		return lua.LNumber(*value)
+	case *float32Value:
+		return float32ToLNumber(float32(*value))
+	case *float32slice:
+		return value.Table(L)
+	case *string:
+		return lua.LString(*value)
+	case *bool:
+		return lua.LBool(*value)
+	case *int:
+		return lua.LNumber(*value)
+	case *int64:
+		return int64ToLValue(*value)
+	case *uint:
+		return uint64ToLValue(uint64(*value))
+	case *uint64:
+		return uint64ToLValue(*value)
+	case *portValue:
+		return lua.LNumber(value.port)
+	case *portslice:
+		return value.Table(L)
+	case *intslice:
+		return value.Table(L)
+	case *numberslice:
+		return value.Table(L)
+	case *stringslice:
+		return value.Table(L)
+	case *boolslice:
+		return value.Table(L)
+	case *counter:
+		return lua.LNumber(*value)
+	case *keyvalues:
+		return value.Table(L)
+	case *time.Duration:
+		return lua.LNumber(*value)
+	case *durationslice:
+		return value.Table(L)
+	case *choiceValue:
+		return lua.LString(value.value)
+	case *customValue:
+		return value.value
+	case *jsonValue:
+		return value.LValue(L)
+	default:
+		L.RaiseError("unknown type: `%T`", f.value)
+	}
+	return lua.LNil
+}
+
+// copyValue returns a copy of the current value of the flag, of the same type
+func (f *flg) copyValue() interface{} {
+	switch value := f.value.(type) {
+	case *float64:
+		c := *value
+		return &c
+	case *float32Value:
+		c := *value
+		return &c
+	case *float32slice:
+		c := append(float32slice(nil), *value...)
+		return &c
+	case *string:
+		c := *value
+		return &c
+	case *bool:
+		c := *value
+		return &c
+	case *int:
+		c := *value
+		return &c
+	case *int64:
+		c := *value
+		return &c
+	case *uint:
+		c := *value
+		return &c
+	case *uint64:
+		c := *value
+		return &c
+	case *portValue:
+		c := *value
+		return &c
+	case *portslice:
+		c := portslice{ports: append([]int(nil), value.ports...), anyPort: value.anyPort}
+		return &c
+	case *intslice:
+		c := append(intslice(nil), *value...)
+		return &c
+	case *numberslice:
+		c := append(numberslice(nil), *value...)
+		return &c
+	case *stringslice:
+		c := append(stringslice(nil), *value...)
+		return &c
+	case *boolslice:
+		c := append(boolslice(nil), *value...)
+		return &c
+	case *counter:
+		c := *value
+		return &c
+	case *keyvalues:
+		c := keyvalues{}
+		for k, v := range *value {
+			c[k] = v
+		}
+		return &c
+	case *time.Duration:
+		c := *value
+		return &c
+	case *durationslice:
+		c := append(durationslice(nil), *value...)
+		return &c
+	case *choiceValue:
+		c := *value
+		return &c
+	case *customValue:
+		c := *value
+		return &c
+	case *jsonValue:
+		c := *value
+		return &c
+	}
+	return f.value
+}
+
+// takesValue reports whether the flag consumes the following argument as its
+// value
+func (f *flg) takesValue() bool {
+	if f.optionalValue != nil {
+		return false
+	}
+	switch value := f.value.(type) {
+	case *bool:
+		return false
+	case interface{ IsBoolFlag() bool }:
+		return !value.IsBoolFlag()
+	}
+	return true
+}
+
+// isSlice reports whether the flag collects repeated values into a table
+func (f *flg) isSlice() bool {
+	switch f.value.(type) {
+	case *numberslice, *float32slice, *intslice, *stringslice, *boolslice, *durationslice, *portslice:
+		return true
+	}
+	return false
+}
+
 type flgs map[string]*flg
 
+// flagOptions are the optional settings of a flag, given either as a
+// completion function or as a table, e.g. {required=true, alias="n", compgen=fn}.
+// Instead of compgen a static list of candidates can be given as complete.
+// Numeric flags also accept min and max bounds and string flags a pattern.
+// A validate function is called with the parsed value and must return true,
+// anything else is reported as error, using a returned string as message.
+// Slice flags with split set also accept comma separated values, and take a
+// list as default, which is replaced by values given on the command line, or
+// with appendDefaults set always included and appended to. Numeric
+// flags with units set to 1000, or 1024 or true, accept k, M and G suffixes
+// and underscores between digits, e.g. 10k or 1_000. Integer flags with a base
+// between 2 and 36 parse values in that base, e.g. ff with base 16, base 0
+// detects the base from the 0x, 0o and 0b prefixes. The value is still
+// returned as a lua number. String flags with fromFile set read a value of
+// @name from the file name, @@ escapes a value starting with @, and with stdin
+// set read all of stdin, until EOF, for the value -. Boolean flags
+// never take the next argument as value, only -flag=false, unless
+// explicitValue is set, then a following true or false is taken as well.
+// Port flags with anyPort set also accept 0, meaning any port. String flags
+// with optionalValue set may be given without a value, -log then takes the
+// optionalValue, -log=name takes name, the next argument is never taken.
+type flagOptions struct {
+	required   bool
+	alias      string
+	min        *float64
+	max        *float64
+	pattern    *regexp.Regexp
+	fromFile   bool
+	stdin      bool
+	deprecated string
+	defaults   []string
+	split      bool
+	units      float64
+	base       *int
+	validate   *lua.LFunction
+	compFn     *lua.LFunction
+	// dynamic is set when a completion function or candidates are given
+	dynamic bool
+	// explicitValue lets a boolean flag take a following true or false
+	explicitValue bool
+	// anyPort lets a port flag take 0
+	anyPort bool
+	// appendDefaults keeps the default list of a slice flag when values are given
+	appendDefaults bool
+	// optionalValue is the value of a flag given without one
+	optionalValue *string
+}
+
+func optFlagOptions(L *lua.LState, n int, compFn *lua.LFunction) *flagOptions {
+	opts := &flagOptions{compFn: compFn}
+
+	switch v := L.Get(n).(type) {
+	case *lua.LFunction:
+		opts.compFn = v
+	case *lua.LTable:
+		opts.required = lua.LVAsBool(v.RawGetString("required"))
+		opts.split = lua.LVAsBool(v.RawGetString("split"))
+		opts.appendDefaults = lua.LVAsBool(v.RawGetString("appendDefaults"))
+		opts.fromFile = lua.LVAsBool(v.RawGetString("fromFile"))
+		opts.stdin = lua.LVAsBool(v.RawGetString("stdin"))
+		opts.explicitValue = lua.LVAsBool(v.RawGetString("explicitValue"))
+		opts.anyPort = lua.LVAsBool(v.RawGetString("anyPort"))
+		if defaults, ok := v.RawGetString("default").(*lua.LTable); ok {
+			opts.defaults = toStringSlice(defaults)
+		}
+		if present, ok := v.RawGetString("optionalValue").(lua.LString); ok {
+			s := string(present)
+			opts.optionalValue = &s
+		}
+		if alias, ok := v.RawGetString("alias").(lua.LString); ok {
+			opts.alias = string(alias)
+		}
+		if deprecated, ok := v.RawGetString("deprecated").(lua.LString); ok {
+			opts.deprecated = string(deprecated)
+		}
+		if min, ok := v.RawGetString("min").(lua.LNumber); ok {
+			m := float64(min)
+			opts.min = &m
+		}
+		if max, ok := v.RawGetString("max").(lua.LNumber); ok {
+			m := float64(max)
+			opts.max = &m
+		}
+		switch units := v.RawGetString("units").(type) {
+		case lua.LBool:
+			if units {
+				opts.units = 1024
+			}
+		case lua.LNumber:
+			if units != 1000 && units != 1024 {
+				L.ArgError(n, "units should be 1000 or 1024")
+			}
+			opts.units = float64(units)
+		}
+		if base, ok := v.RawGetString("base").(lua.LNumber); ok {
+			b := int(base)
+			if b != 0 && (b < 2 || b > 36) {
+				L.ArgError(n, "base should be 0 or between 2 and 36")
+			}
+			opts.base = &b
+			// the unit suffixes are decimal, they could be digits in the base
+			if opts.units != 0 {
+				L.ArgError(n, "units can not be combined with base")
+			}
+		}
+		if pattern, ok := v.RawGetString("pattern").(lua.LString); ok {
+			re, err := regexp.Compile(string(pattern))
+			if err != nil {
+				L.ArgError(n, fmt.Sprintf("invalid pattern: %v", err))
+			}
+			opts.pattern = re
+		}
+		if fn, ok := v.RawGetString("validate").(*lua.LFunction); ok {
+			opts.validate = fn
+		}
+		if candidates, ok := v.RawGetString("complete").(*lua.LTable); ok {
+			opts.compFn = staticCompFn(L, toStringSlice(candidates))
+		}
+		if fn, ok := v.RawGetString("compgen").(*lua.LFunction); ok {
+			opts.compFn = fn
+		}
+	default:
+		if v != lua.LNil {
+			L.TypeError(n, lua.LTTable)
+		}
+	}
+
+	opts.dynamic = opts.compFn != compFn
+	return opts
+}
+
 type argument struct {
 	name       string
 	times      int
@@ -36,7 +398,35 @@ type argument struct {
 	typ        string
 	parser     parser
 	shortUsage shortUsage
+	nargs      string
+	slice      bool
+	def        lua.LValue
 	compFn     *lua.LFunction
+	dynamic    bool
+	rest       bool
+}
+
+// argOptions are the optional settings of a positional argument, given as a
+// table, e.g. {default="."}
+type argOptions struct {
+	def lua.LValue
+}
+
+func optArgOptions(L *lua.LState, n int) *argOptions {
+	opts := &argOptions{}
+
+	switch v := L.Get(n).(type) {
+	case *lua.LTable:
+		if def := v.RawGetString("default"); def != lua.LNil {
+			opts.def = def
+		}
+	default:
+		if v != lua.LNil {
+			L.TypeError(n, lua.LTTable)
+		}
+	}
+
+	return opts
 }
 
 func (a *argument) parse(args []string, L *lua.LState) ([]string, error) {
@@ -45,21 +435,109 @@ func (a *argument) parse(args []string, L *lua.LState) ([]string, error) {
 	return args, err
 }
 
+// toLValue returns the parsed value, or the default if the argument was
+// omitted
 func (a *argument) toLValue(L *lua.LState) lua.LValue {
+	if a.def != nil && a.omitted() {
+		return a.def
+	}
 	return a.value
 }
 
-func (a *argument) generateUsage() string {
+// omitted reports whether the last parse did not find the argument
+func (a *argument) omitted() bool {
+	if t, ok := a.value.(*lua.LTable); ok {
+		return t.Len() == 0
+	}
+	return a.value == lua.LNil
+}
+
+// defValue returns the default of the argument as text, or an empty string
+// if it has none. A list of defaults is formatted like the slice flags.
+func (a *argument) defValue() string {
+	switch def := a.def.(type) {
+	case nil:
+		return ""
+	case *lua.LTable:
+		return fmt.Sprintf("%v", toStringSlice(def))
+	default:
+		return def.String()
+	}
+}
+
+// checkDefault returns an error if the default is not a value of the type of
+// the argument, or a table of them for an argument taking several values
+func (a *argument) checkDefault() error {
+	if a.def == nil {
+		return nil
+	}
+	if !a.slice {
+		return a.checkDefaultValue(a.def)
+	}
+
+	t, ok := a.def.(*lua.LTable)
+	if !ok {
+		return fmt.Errorf("%v: default must be a table", a.name)
+	}
+	var err error
+	t.ForEach(func(_, v lua.LValue) {
+		if err == nil {
+			err = a.checkDefaultValue(v)
+		}
+	})
+	return err
+}
+
+// checkDefaultValue returns an error if v is not a value of the type of the
+// argument
+func (a *argument) checkDefaultValue(v lua.LValue) error {
+	ok := false
+	switch a.typ {
+	case "string":
+		_, ok = v.(lua.LString)
+	case "int":
+		n, isNumber := v.(lua.LNumber)
+		ok = isNumber && float64(n) == math.Trunc(float64(n))
+	case "number":
+		_, ok = v.(lua.LNumber)
+	}
+	if !ok {
+		return fmt.Errorf("%v: invalid %v default: %v", a.name, a.typ, v)
+	}
+	return nil
+}
+
+func (a *argument) generateUsage(width int) string {
 	typ := a.typ
 	if typ == "" {
 		typ = "string"
 	}
 
-	return fmt.Sprintf("  %v %v\n    \t%v\n", a.name, typ, a.usage)
+	usage := a.usage
+	if a.def != nil {
+		if _, ok := a.def.(lua.LString); ok {
+			usage += fmt.Sprintf(" (default %q)", a.def.String())
+		} else {
+			usage += fmt.Sprintf(" (default %v)", a.defValue())
+		}
+	}
+	usage = strings.Replace(wrapText(usage, width-usageIndent), "\n", "\n    \t", -1)
+	return fmt.Sprintf("  %v%v %v\n    \t%v\n", a.name, a.nargs, typ, usage)
 }
 
 type arguments []*argument
 
+// valueError is returned by the argument parsers for a value that can not be
+// converted to the type of the argument
+type valueError struct {
+	typ   string
+	value string
+}
+
+func (e *valueError) Error() string {
+	return fmt.Sprintf("invalid %v value: %v", e.typ, e.value)
+}
+
 type parser func([]string, *lua.LState) ([]string, lua.LValue, error)
 
 type shortUsage func(string) string
@@ -122,7 +600,7 @@ func parseOptionalInt(args []string, L *lua.LState) ([]string, lua.LValue, error
 	}
 	i, err := strconv.Atoi(args[0])
 	if err != nil {
-		return args[1:len(args)], lua.LNumber(0), fmt.Errorf("invalid integer value: %v", args[0])
+		return args[1:len(args)], lua.LNumber(0), &valueError{typ: "integer", value: args[0]}
 	}
 	return args[1:len(args)], lua.LNumber(i), nil
 }
@@ -136,7 +614,7 @@ func parseNInts(n int) parser {
 		for i := 0; i < n; i++ {
 			v, err := strconv.Atoi(args[i])
 			if err != nil {
-				return args[1:len(args)], lua.LNumber(0), fmt.Errorf("invalid integer value: %v", args[i])
+				return args[1:len(args)], lua.LNumber(0), &valueError{typ: "integer", value: args[i]}
 			}
 			table.Append(lua.LNumber(v))
 		}
@@ -157,7 +635,7 @@ func parseOptionalInts(args []string, L *lua.LState) ([]string, lua.LValue, erro
 	for i := 0; i < len(args); i++ {
 		v, err := strconv.Atoi(args[i])
 		if err != nil {
-			return args[1:len(args)], lua.LNumber(0), fmt.Errorf("invalid integer value: %v", args[i])
+			return args[1:len(args)], lua.LNumber(0), &valueError{typ: "integer", value: args[i]}
 		}
 		table.Append(lua.LNumber(v))
 	}
@@ -178,7 +656,7 @@ func parseOptionalNumber(args []string, L *lua.LState) ([]string, lua.LValue, er
 	}
 	i, err := strconv.ParseFloat(args[0], 64)
 	if err != nil {
-		return args[1:len(args)], lua.LNumber(0), fmt.Errorf("invalid number value: %v", args[0])
+		return args[1:len(args)], lua.LNumber(0), &valueError{typ: "number", value: args[0]}
 	}
 	return args[1:len(args)], lua.LNumber(i), nil
 }
@@ -192,7 +670,7 @@ func parseNNumbers(n int) parser {
 		for i := 0; i < n; i++ {
 			v, err := strconv.ParseFloat(args[i], 64)
 			if err != nil {
-				return args[1:len(args)], lua.LNumber(0), fmt.Errorf("invalid number value: %v", args[i])
+				return args[1:len(args)], lua.LNumber(0), &valueError{typ: "number", value: args[i]}
 			}
 			table.Append(lua.LNumber(v))
 		}
@@ -213,13 +691,114 @@ func parseOptionalNumbers(args []string, L *lua.LState) ([]string, lua.LValue, e
 	for i := 0; i < len(args); i++ {
 		v, err := strconv.ParseFloat(args[i], 64)
 		if err != nil {
-			return args[1:len(args)], lua.LNumber(0), fmt.Errorf("invalid number value: %v", args[i])
+			return args[1:len(args)], lua.LNumber(0), &valueError{typ: "number", value: args[i]}
 		}
 		table.Append(lua.LNumber(v))
 	}
 	return make([]string, 0), table, nil
 }
 
+// range parsers
+func parseRange(typ string, min, max int) parser {
+	return func(args []string, L *lua.LState) ([]string, lua.LValue, error) {
+		n := len(args)
+		if max >= 0 && n > max {
+			n = max
+		}
+		if n < min {
+			return args, lua.LNil, fmt.Errorf("expected %v", describeRange(typ, min, max))
+		}
+		table := L.NewTable()
+		for i := 0; i < n; i++ {
+			v, err := convertArgument(typ, args[i])
+			if err != nil {
+				return args[1:len(args)], lua.LNumber(0), err
+			}
+			table.Append(v)
+		}
+		return args[n:len(args)], table, nil
+	}
+}
+
+func convertArgument(typ string, arg string) (lua.LValue, error) {
+	switch typ {
+	case "int":
+		v, err := strconv.Atoi(arg)
+		if err != nil {
+			return lua.LNumber(0), &valueError{typ: "integer", value: arg}
+		}
+		return lua.LNumber(v), nil
+	case "number":
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return lua.LNumber(0), &valueError{typ: "number", value: arg}
+		}
+		return lua.LNumber(v), nil
+	}
+	return lua.LString(arg), nil
+}
+
+func describeRange(typ string, min, max int) string {
+	plural := map[string]string{
+		"string": "strings",
+		"int":    "integers",
+		"number": "numbers",
+	}[typ]
+
+	if max < 0 {
+		return fmt.Sprintf("at least %v %v", min, plural)
+	}
+	return fmt.Sprintf("between %v and %v %v", min, max, plural)
+}
+
+// toRange returns the min and max of a nargs range table, e.g. {min=2, max=5},
+// a missing max is returned as -1
+func toRange(t *lua.LTable) (int, int, error) {
+	min, max := 0, -1
+	if v, ok := t.RawGetString("min").(lua.LNumber); ok {
+		min = int(v)
+	}
+	if v, ok := t.RawGetString("max").(lua.LNumber); ok {
+		max = int(v)
+	}
+
+	switch {
+	case min < 0:
+		return 0, 0, fmt.Errorf("nargs range min should not be negative")
+	case max >= 0 && min > max:
+		return 0, 0, fmt.Errorf("nargs range min should not exceed max")
+	}
+	return min, max, nil
+}
+
+// isSliceOption reports whether the nargs option yields a table of values
+func isSliceOption(option lua.LValue) bool {
+	switch t := option.(type) {
+	case lua.LString:
+		return t == "+" || t == "*"
+	case lua.LNumber:
+		return int(t) > 1
+	case *lua.LTable:
+		return true
+	}
+	return false
+}
+
+func rangeUsage(option lua.LValue) string {
+	t, ok := option.(*lua.LTable)
+	if !ok {
+		return ""
+	}
+	min, max, err := toRange(t)
+	if err != nil {
+		return ""
+	}
+	if max < 0 {
+		return fmt.Sprintf("{%v,}", min)
+	}
+	return fmt.Sprintf("{%v,%v}", min, max)
+}
+
 func getParser(typ string, option lua.LValue) (parser, error) {
 	parsers := map[string]map[string]parser{
 		"string": {
@@ -260,9 +839,15 @@ func getParser(typ string, option lua.LValue) (parser, error) {
 		case int(t) > 1:
 			return nParsers[typ](int(t)), nil
 		}
+	case *lua.LTable:
+		min, max, err := toRange(t)
+		if err != nil {
+			return nil, err
+		}
+		return parseRange(typ, min, max), nil
 	}
 
-	return nil, fmt.Errorf("nargs should be an integer or one of '?', '*', or '+'")
+	return nil, fmt.Errorf("nargs should be an integer, a range table, or one of '?', '*', or '+'")
 }
 
 func getShortUsageFn(option lua.LValue) (shortUsage, error) {
@@ -304,7 +889,15 @@ func getShortUsageFn(option lua.LValue) (shortUsage, error) {
 		case int(t) > 1:
 			return shortNUsage(int(t)), nil
 		}
+	case *lua.LTable:
+		if _, _, err := toRange(t); err != nil {
+			return nil, err
+		}
+		usage := rangeUsage(t)
+		return func(name string) string {
+			return fmt.Sprintf("%v%v ", name, usage)
+		}, nil
 	}
 
-	return nil, fmt.Errorf("nargs should be an integer or one of '?', '*', or '+'")
+	return nil, fmt.Errorf("nargs should be an integer, a range table, or one of '?', '*', or '+'")
 }
@@ -2,8 +2,13 @@ package gluaflag
 
 import (
 	"bytes"
+	"errors"
+	"flag"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -107,6 +112,76 @@ func TestUsage(t *testing.T) {
 	}
 }
 
+func TestSetOutput(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-foo"}
+	arg[0] = "subcmd"
+	fs = flag.new("subcommand")
+	fs:number("times", 1, "Number help string")
+	local out = {}
+	fs:setOutput(function(s) table.insert(out, s) end)
+	ok, err = pcall(function() fs:parse(arg) end)
+
+	print(table.concat(out))
+	`
+
+	expected := strings.Join([]string{
+		"usage: subcommand [options]",
+		"  -times float",
+		"    	Number help string (default 1)",
+		"",
+	}, "\n")
+	got, stderr := doString(src, t)
+
+	if got != expected || stderr != "" {
+		t.Errorf("expected stdout: `%v`\ngot: `%v`\nexpected empty stderr, got: `%v`\nsrc: `%v`", expected, got, stderr, src)
+	}
+}
+
+func TestUsageOnError(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-foo"}
+	arg[0] = "subcmd"
+	fs = flag.new("subcommand")
+	fs:number("times", 1, "Number help string")
+	fs:setOutput(function(s) out = out .. s end)
+
+	for _, mode in ipairs({"short", "none", "full"}) do
+		out = ""
+		fs:usageOnError(mode)
+		pcall(function() fs:parse(arg) end)
+		print(mode .. ": " .. out)
+	end
+
+	ok, err = pcall(function() fs:usageOnError("some") end)
+	print(err)
+
+	out = ""
+	fs:returnErrors()
+	fs:parse(arg)
+	print("returned: " .. out)
+	`
+
+	expected := strings.Join([]string{
+		"short: usage: subcommand [options]",
+		"",
+		"none: ",
+		"full: usage: subcommand [options]",
+		"  -times float",
+		"    	Number help string (default 1)",
+		"",
+		"<string>:16: bad argument #2 to usageOnError (usage mode should be one of 'full', 'short', or 'none')",
+		"returned: ",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
 func TestNumberFlag(t *testing.T) {
 	src := `
 	local flag = require('flag')
@@ -128,6 +203,33 @@ func TestNumberFlag(t *testing.T) {
 	}
 }
 
+func TestFloat32Flag(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-ratio", "0.1", "-ratios", "0.2", "-ratios", "1.5"}
+	arg[0] = "subcmd"
+	fs = flag.new()
+	fs:float32("ratio", 1, "Float32 help string")
+	fs:float32s("ratios", "Float32 slice help string")
+	flags = fs:parse(arg)
+
+	print(flags.ratio)
+	print(flags.ratio == 0.1)
+	print(table.concat(flags.ratios, ","))
+	`
+
+	expected := strings.Join([]string{
+		"0.1",
+		"true",
+		"0.2,1.5",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
 func TestIntFlag(t *testing.T) {
 	src := `
 	local flag = require('flag')
@@ -149,6 +251,103 @@ func TestIntFlag(t *testing.T) {
 	}
 }
 
+func TestInt64Flag(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-big", "9223372036854775807", "-small", "-42"}
+	arg[0] = "subcmd"
+	fs = flag.new()
+	fs:int64("big", 0, "Int64 help string")
+	fs:int64("small", 0, "Int64 help string")
+	flags = fs:parse(arg)
+
+	print(flags.big)
+	print(type(flags.big))
+	print(flags.small)
+	print(type(flags.small))
+	`
+
+	expected := strings.Join([]string{
+		"9223372036854775807",
+		"string",
+		"-42",
+		"number",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestUintFlag(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-port", "8080", "-size", "18446744073709551615"}
+	arg[0] = "subcmd"
+	fs = flag.new()
+	fs:uint("port", 80, "Uint help string")
+	fs:uint64("size", 0, "Uint64 help string")
+	flags = fs:parse(arg)
+
+	print(flags.port)
+	print(type(flags.port))
+	print(flags.size)
+	print(type(flags.size))
+	`
+
+	expected := strings.Join([]string{
+		"8080",
+		"number",
+		"18446744073709551615",
+		"string",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestIntFlagBounds(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:int("workers", 4, "Int help string", {min=1, max=64})
+	fs:number("ratio", 0.5, "Number help string", {max=1})
+
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-workers", "128"}) end)
+	print(err)
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-workers", "0"}) end)
+	print(err)
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-ratio", "1.5"}) end)
+	print(err)
+	flags = fs:parse({[0] = "subcmd", "-workers", "8", "-ratio", "-3"})
+	print(flags.workers .. " " .. flags.ratio)
+
+	ok, err = pcall(function() fs:int("threads", 0, "Int help string", {min=1}) end)
+	print(err)
+
+	fs:number("size", 0, "Number help string", {max=1e21})
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-size", "2e21"}) end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		`<string>:7: invalid value "128" for flag -workers: workers: 128 exceeds max 64`,
+		`<string>:9: invalid value "0" for flag -workers: workers: 0 is below min 1`,
+		`<string>:11: invalid value "1.5" for flag -ratio: ratio: 1.5 exceeds max 1`,
+		"8 -3",
+		"<string>:16: bad argument #3 to int (threads: 0 is below min 1)",
+		`<string>:20: invalid value "2e21" for flag -size: size: 2000000000000000000000 exceeds max 1000000000000000000000`,
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
 func TestIntSliceFlag(t *testing.T) {
 	src := `
 	local flag = require('flag')
@@ -227,6 +426,43 @@ func TestNumberFlagAndArgs(t *testing.T) {
 	}
 }
 
+func TestFlagTerminator(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-x", "1", "--", "-y", "2"}
+	arg[0] = "subcmd"
+	fs = flag.new()
+	fs:int("x", 0, "Int help string")
+	fs:int("y", 0, "Int help string")
+	flags = fs:parse(arg)
+
+	print(flags.x)
+	print(flags.y)
+	for i, v in ipairs(flags) do
+		print(i .. "=" .. v .. " " .. type(v))
+	end
+
+	fs = flag.new()
+	fs:int("x", 0, "Int help string")
+	fs:stringArg("rest", "*", "Rest")
+	flags = fs:parse(arg)
+	print(table.concat(flags.rest, " "))
+	`
+
+	expected := strings.Join([]string{
+		"1",
+		"0",
+		"1=-y string",
+		"2=2 string",
+		"-y 2",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
 func TestNumberSliceFlag(t *testing.T) {
 	src := `
 	local flag = require('flag')
@@ -272,6 +508,37 @@ func TestStringFlag(t *testing.T) {
 	}
 }
 
+func TestStringFlagPattern(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("tag", "", "String help string", {pattern="^[a-z0-9-]+$"})
+	fs:strings("label", "Strings help string", {pattern="^[a-z]+$"})
+
+	flags = fs:parse({[0] = "subcmd", "-tag", "v1-2", "-label", "foo", "-label", "bar"})
+	print(flags.tag .. " " .. table.concat(flags.label, ","))
+
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-tag", "V1"}) end)
+	print(err)
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-label", "foo", "-label", "b4r"}) end)
+	print(err)
+	ok, err = pcall(function() fs:string("bad", "", "String help string", {pattern="("}) end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"v1-2 foo,bar",
+		`<string>:10: invalid value "V1" for flag -tag: tag: "V1" does not match pattern "^[a-z0-9-]+$"`,
+		`<string>:12: invalid value "b4r" for flag -label: label: "b4r" does not match pattern "^[a-z]+$"`,
+		"<string>:14: bad argument #5 to string (invalid pattern: error parsing regexp: missing closing ): `(`)",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
 func TestStringFlagCompgen(t *testing.T) {
 	src := `
 	local flag = require('flag')
@@ -299,6 +566,41 @@ func TestStringFlagCompgen(t *testing.T) {
 	}
 }
 
+func TestStringFlagCompgenJoinedValue(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	local fs = flag.new()
+	fs:string("name", "foo", "String help string", function(word)
+		local res = {}
+		for _, v in ipairs({"bar", "foo", "fum"}) do
+			if v:sub(1, #word) == word then
+				table.insert(res, v)
+			end
+		end
+		return res
+	end)
+	fs:bool("q", false, "Bool help string")
+
+	local arg = {"-name=fo"}
+	arg[0] = "subcommand"
+	print(table.concat(fs:compgen(1, arg), " "))
+
+	arg = {"-q=t"}
+	arg[0] = "subcommand"
+	print(#fs:compgen(1, arg))
+	`
+
+	expected := strings.Join([]string{
+		"foo",
+		"0",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
 func TestStringSliceFlag(t *testing.T) {
 	src := `
 	local flag = require('flag')
@@ -341,22 +643,25 @@ func TestStringSliceNoValues(t *testing.T) {
 	}
 }
 
-func TestBoolFlag(t *testing.T) {
+func TestDurationFlag(t *testing.T) {
 	src := `
 	local flag = require('flag')
-	arg = {"-q"}
+	arg = {"-timeout", "2m30s"}
 	arg[0] = "subcmd"
 	fs = flag.new()
-	fs:bool("q", false, "Bool help string")
+	fs:duration("timeout", "5s", "Duration help string")
+	fs:duration("wait", 2, "Duration help string")
 	flags = fs:parse(arg)
 
-	print(flags.q)
-	print(type(flags.q))
+	print(flags.timeout)
+	print(flags.wait)
+	print(type(flags.timeout))
 	`
 
 	expected := strings.Join([]string{
-		"true",
-		"boolean",
+		"150000000000",
+		"2000000000",
+		"number",
 	}, "\n")
 	got, _ := doString(src, t)
 
@@ -365,43 +670,15 @@ func TestBoolFlag(t *testing.T) {
 	}
 }
 
-func TestStringArg(t *testing.T) {
+func TestDurationFlagInvalidDefault(t *testing.T) {
 	src := `
 	local flag = require('flag')
-	arg = {"test", "-name", "foo", "mr"}
 	fs = flag.new()
-	local function compgen()
-		return "fii foo fum"
-	end
-	fs:string("name", "foo", "String help string", compgen)
-	fs:stringArg("title", 1, "Title", function()
-		return "mr miss mrs"
-	end)
-	flags = fs:parse(arg)
-
-	function pairsByKeys(t)
-		local a = {}
-		for n in pairs(t) do table.insert(a, n) end
-		table.sort(a)
-		local i = 0			-- iterator variable
-		local iter = function ()	 -- iterator function
-			i = i + 1
-			if a[i] == nil then return nil
-			else return a[i], t[a[i]]
-			end
-		end
-		return iter
-	end
-
-	for k, v in pairsByKeys(flags) do
-		print(k .. " " .. v)
-	end
+	ok, err = pcall(function() fs:duration("timeout", "soon", "Duration help string") end)
+	print(err)
 	`
 
-	expected := strings.Join([]string{
-		"name foo",
-		"title mr",
-	}, "\n")
+	expected := "<string>:4: invalid duration value: soon"
 	got, _ := doString(src, t)
 
 	if got != expected {
@@ -409,140 +686,256 @@ func TestStringArg(t *testing.T) {
 	}
 }
 
-func TestOptionalStringArg(t *testing.T) {
+func TestDurationSliceFlag(t *testing.T) {
 	src := `
 	local flag = require('flag')
-	arg = {"-name", "foo", "bar"}
-	arg[0] = "subcommand"
+	arg = {"-wait", "1s", "-wait", "1ms"}
+	arg[0] = "subcmd"
 	fs = flag.new()
-	fs:string("name", "foo", "String help string")
-	fs:stringArg("title", "?", "Title")
+	fs:durations("wait", "Duration help string")
 	flags = fs:parse(arg)
-	assert(flags.title == "bar", "expected flags.title to be 'bar'")
+
+	print(type(flags.wait))
+	print(table.concat(flags.wait, ","))
 	`
-	doString(src, t)
+
+	expected := "table\n1000000000,1000000"
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
 }
 
-func TestOptionalStringsArg(t *testing.T) {
+func TestBoolSliceFlag(t *testing.T) {
 	src := `
 	local flag = require('flag')
-	arg = {"-name", "foo", "bar"}
-	arg[0] = "subcommand"
+	arg = {"-feature", "-feature=false", "-feature=true"}
+	arg[0] = "subcmd"
 	fs = flag.new()
-	fs:string("name", "foo", "String help string")
-	fs:stringArg("title", "*", "Title")
+	fs:bools("feature", "Bool slice help string")
 	flags = fs:parse(arg)
-	assert(type(flags.title) == "table", "expected flags.title to be a 'table'")
-	assert(#flags.title == 1, "expected flags.title to have length == 1")
-	assert(flags.title[1] == "bar", "expected flags.title[1] to be 'bar'")
-	`
-	doString(src, t)
-}
 
-func TestStringsArg(t *testing.T) {
+	print(type(flags.feature))
+	for _, v in ipairs(flags.feature) do
+		print(v)
+	end
+
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-feature=maybe"}) end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"table",
+		"true",
+		"false",
+		"true",
+		`<string>:14: invalid boolean value "maybe" for -feature: strconv.ParseBool: parsing "maybe": invalid syntax`,
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestSplitBoolSliceFlag(t *testing.T) {
 	src := `
 	local flag = require('flag')
-	arg = {"-name", "foo", "bar"}
-	arg[0] = "subcommand"
 	fs = flag.new()
-	fs:string("name", "foo", "String help string")
-	fs:stringArg("title", "+", "Title")
+	fs:bools("v", "Verbose", {split=true})
+	fs:stringArg("file", "?", "File")
+
+	flags = fs:parseArgs({"-v", "-v", "-v=false,true", "f"})
+	print(table.concat({tostring(flags.v[1]), tostring(flags.v[2]), tostring(flags.v[3]), tostring(flags.v[4])}, " "), flags.file)
+	print(fs:flagUsage("v"))
+	`
+
+	expected := strings.Join([]string{
+		"true true false true\tf",
+		"  -v\tVerbose",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCountFlag(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-v", "-v"}
+	arg[0] = "subcmd"
+	fs = flag.new()
+	fs:count("v", 0, "Count help string")
+	fs:count("d", 1, "Count help string")
 	flags = fs:parse(arg)
-	assert(type(flags.title) == "table", "expected flags.title to be a 'table'")
-	assert(#flags.title == 1, "expected flags.title to have length == 1")
-	assert(flags.title[1] == "bar", "expected flags.title[1] to be 'bar'")
+
+	print(flags.v)
+	print(flags.d)
+	print(type(flags.v))
 	`
-	doString(src, t)
+
+	expected := strings.Join([]string{
+		"2",
+		"1",
+		"number",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
 }
 
-func TestStringsArgToFew(t *testing.T) {
+func TestChoiceFlag(t *testing.T) {
 	src := `
 	local flag = require('flag')
-	arg = {"-name", "foo"}
-	arg[0] = "subcommand"
+	arg = {"-mode", "slow"}
+	arg[0] = "subcmd"
 	fs = flag.new()
-	fs:string("name", "foo", "String help string")
-	fs:stringArg("title", "+", "Title")
-	ok, err = pcall(function() fs:parse(arg) end)
+	fs:choice("mode", "fast", {"fast", "slow", "auto"}, "Choice help string")
+	flags = fs:parse(arg)
+	print(flags.mode)
+
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-mode", "bogus"}) end)
 	print(err)
 	`
-	expected := "<string>:8: argument title: expected at least one string"
-	stdout, _ := doString(src, t)
-	if stdout != expected {
-		t.Errorf("expected: `%v`\ngot: `%v`\nsrc: `%v`", expected, stdout, src)
+
+	expected := strings.Join([]string{
+		"slow",
+		`<string>:10: invalid value "bogus" for flag -mode: invalid choice "bogus", valid choices are: fast, slow, auto`,
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
 	}
 }
 
-func TestNStringsArgument(t *testing.T) {
+func TestChoiceFlagInvalidDefault(t *testing.T) {
 	src := `
 	local flag = require('flag')
-	arg = {"-name", "foo", "bar", "baz"}
-	arg[0] = "subcommand"
 	fs = flag.new()
-	fs:string("name", "foo", "String help string")
-	fs:stringArg("title", 2, "Title")
-	flags = fs:parse(arg)
-	assert(type(flags.title) == "table", "expected flags.title to be a 'table'")
-	assert(#flags.title == 2, "expected flags.title to have length == 1")
-	assert(flags.title[1] == "bar", "expected flags.title[1] to be 'bar'")
-	assert(flags.title[2] == "baz", "expected flags.title[1] to be 'baz'")
+	ok, err = pcall(function() fs:choice("mode", "bogus", {"fast", "slow"}, "Choice help string") end)
+	print(err)
+	ok, err = pcall(function() fs:choice("mode", "fast", {}, "Choice help string") end)
+	print(err)
 	`
-	doString(src, t)
+
+	expected := strings.Join([]string{
+		`<string>:4: bad argument #3 to choice (invalid choice "bogus", valid choices are: fast, slow)`,
+		`<string>:6: bad argument #4 to choice (expected at least one choice)`,
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
 }
 
-func TestNStringsArgToFew(t *testing.T) {
+func TestChoiceFlagCompgen(t *testing.T) {
 	src := `
 	local flag = require('flag')
-	arg = {"-name", "foo", "bar"}
+	local arg = {"-mode"}
 	arg[0] = "subcommand"
+	local fs = flag.new()
+	fs:choice("mode", "fast", {"fast", "slow", "auto"}, "Choice help string")
+	flags = fs:compgen(2, arg)
+
+	print(table.concat(flags, "\n"))
+	`
+
+	expected := "fast slow auto"
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestKeyValueFlag(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-set", "key=value", "-set", "other=thing", "-set", "key=new", "-set", "empty=", "-set", "eq=a=b"}
+	arg[0] = "subcmd"
 	fs = flag.new()
-	fs:string("name", "foo", "String help string")
-	fs:stringArg("title", 2, "Title")
-	ok, err = pcall(function() fs:parse(arg) end)
+	fs:keyvalue("set", "Key value help string")
+	flags = fs:parse(arg)
+
+	print(flags.set.key)
+	print(flags.set.other)
+	print(flags.set.empty == "")
+	print(flags.set.eq)
+
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-set", "novalue"}) end)
 	print(err)
 	`
-	expected := "<string>:8: argument title: expected 2 strings"
-	stdout, _ := doString(src, t)
-	if stdout != expected {
-		t.Errorf("expected: `%v`\ngot: `%v`\nsrc: `%v`", expected, stdout, src)
+
+	expected := strings.Join([]string{
+		"new",
+		"thing",
+		"true",
+		"a=b",
+		`<string>:14: invalid value "novalue" for flag -set: expected key=value, got: novalue`,
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
 	}
 }
 
-func TestStringArgumentCompgen(t *testing.T) {
+func TestBoolFlag(t *testing.T) {
 	src := `
 	local flag = require('flag')
+	arg = {"-q"}
+	arg[0] = "subcmd"
+	fs = flag.new()
+	fs:bool("q", false, "Bool help string")
+	flags = fs:parse(arg)
 
-	fs = flag.new("subcommand")
-	local function compgen()
-		return "fii", "foo", "fum"
-	end
+	print(flags.q)
+	print(type(flags.q))
+	`
 
-	res = {}
-	fs:string("name", "foo", "String help string", compgen)
-	fs:stringArg("mr", 1, "Title", function(arg, flags, raw)
-		res.arg = arg
-		res.flags = flags
-		res.raw = raw
-		return "mr", "miss", "mrs"
-	end)
+	expected := strings.Join([]string{
+		"true",
+		"boolean",
+	}, "\n")
+	got, _ := doString(src, t)
 
-	local arg = {"-name", "foo", "m"}
-	arg[0] = "subcommand"
-	flags = fs:compgen(3, arg)
-	assert(res.arg == "m", "expected arg to be 'm', got " .. res.arg)
-	assert(res.flags.name == "foo", "expected flag.names to be 'foo', got " .. res.flags.name)
-	assert(res.raw[0] == "subcommand", "expected raw[0] to be 'subcommand', got " .. res.raw[0])
-	assert(res.raw[1] == "-name", "expected raw[1] to be '-name', got " .. res.raw[1])
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
 
-	print(table.concat(flags, " "))
+func TestFlagIsSet(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-q"}
+	arg[0] = "subcmd"
+	fs = flag.new()
+	fs:bool("q", false, "Bool help string")
+	fs:bool("verbose", false, "Bool help string")
+	fs:string("name", "", "String help string", {alias="n"})
+	flags = fs:parse(arg)
+
+	print(fs:set("q"))
+	print(fs:set("verbose"))
+	print(fs:set("unknown"))
 
+	flags = fs:parse({[0] = "subcmd", "-n", "bob"})
+	print(fs:set("n"), fs:set("name"))
 	`
 
 	expected := strings.Join([]string{
-		"mrs",
-		"miss",
-		"mr",
-	}, " ")
+		"true",
+		"false",
+		"false",
+		"true\ttrue",
+	}, "\n")
 	got, _ := doString(src, t)
 
 	if got != expected {
@@ -550,29 +943,27 @@ func TestStringArgumentCompgen(t *testing.T) {
 	}
 }
 
-func TeststringArgumentCompgen2(t *testing.T) {
+func TestRequiredFlags(t *testing.T) {
 	src := `
 	local flag = require('flag')
-	arg = {"-name", "foo", "m"}
-	arg[0] = "subcommand"
 	fs = flag.new()
-	local function compgen()
-		return "fii foo fum"
-	end
-	fs:string("name", "foo", "String help string", compgen)
-	fs:stringArgument("mr", 1, "Title", function()
-		return "mr miss mrs"
-	end)
-	flags = fs:compgen(3, arg)
+	fs:string("name", "", "String help string", {required=true})
+	fs:int("times", 1, "Int help string", {required=true})
+	fs:bool("q", false, "Bool help string")
 
-	print(flags)
+	ok, err = pcall(function() fs:parse({[0] = "subcmd"}) end)
+	print(err)
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-name", "foo"}) end)
+	print(err)
+	flags = fs:parse({[0] = "subcmd", "-name", "foo", "-times", "2"})
+	print(flags.name .. " " .. flags.times)
 	`
 
 	expected := strings.Join([]string{
-		"mr",
-		"miss",
-		"mrs",
-	}, " ")
+		"<string>:8: flags -name, -times are required",
+		"<string>:10: flag -times is required",
+		"foo 2",
+	}, "\n")
 	got, _ := doString(src, t)
 
 	if got != expected {
@@ -580,23 +971,2819 @@ func TeststringArgumentCompgen2(t *testing.T) {
 	}
 }
 
-func TestStringArgumentUsage(t *testing.T) {
+func TestExclusiveFlags(t *testing.T) {
 	src := `
 	local flag = require('flag')
-	fs = flag.new("subcommand")
-	fs:stringArg("title", 1, "Your title")
+	fs = flag.new()
+	fs:bool("json", false, "Bool help string")
+	fs:bool("yaml", false, "Bool help string")
+	fs:bool("a", false, "Bool help string")
+	fs:bool("b", false, "Bool help string")
+	fs:exclusive({"json", "yaml"})
+	fs:exclusive({"a", "b"})
+
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-json", "-yaml"}) end)
+	print(err)
+	fs:reset()
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-json", "-b", "-a"}) end)
+	print(err)
+	fs:reset()
+	flags = fs:parse({[0] = "subcmd", "-json", "-a"})
+	print(flags.json)
+	fs:reset()
+	flags = fs:parse({[0] = "subcmd"})
+	print(flags.json)
+
+	ok, err = pcall(function() fs:exclusive({"json", "xml"}) end)
+	print(err)
+	`
 
-	print(fs:usage())
+	expected := strings.Join([]string{
+		"<string>:11: flags -json, -yaml are mutually exclusive",
+		"<string>:14: flags -a, -b are mutually exclusive",
+		"true",
+		"false",
+		"<string>:23: bad argument #2 to exclusive (no such flag -xml)",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestRequiredTogetherFlags(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("user", "", "String help string")
+	fs:string("password", "", "String help string")
+	fs:string("token", "", "String help string")
+	fs:requiredTogether({"user", "password", "token"})
+
+	ok, err = pcall(function() fs:parse({[0] = "subcmd", "-user", "foo"}) end)
+	print(err)
+	fs:reset()
+	flags = fs:parse({[0] = "subcmd", "-user", "foo", "-password", "bar", "-token", "baz"})
+	print(flags.user .. " " .. flags.password .. " " .. flags.token)
+	fs:reset()
+	flags = fs:parse({[0] = "subcmd"})
+	print(flags.user == "")
 	`
 
 	expected := strings.Join([]string{
-		"usage: subcommand title ",
-		"  title string",
-		"    \tYour title\n",
+		"<string>:9: flags -password, -token are required together with -user",
+		"foo bar baz",
+		"true",
 	}, "\n")
 	got, _ := doString(src, t)
 
 	if got != expected {
-		t.Errorf("expected stdout: `%v`\ngot: `%v`\nsrc: `%v`", expected, got, src)
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestDeprecatedFlag(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("oldname", "", "String help string")
+	fs:string("other", "", "String help string", {deprecated="use -name instead"})
+	fs:string("name", "", "String help string")
+	fs:deprecated("oldname", "use -name instead")
+	out = ""
+	fs:setOutput(function(s) out = out .. s end)
+
+	flags = fs:parse({[0] = "subcmd", "-oldname", "foo", "-other", "bar"})
+	print(out .. flags.oldname .. " " .. flags.other)
+	out = ""
+	fs:reset()
+	flags = fs:parse({[0] = "subcmd", "-name", "foo"})
+	print(out .. flags.name)
+	`
+
+	expected := strings.Join([]string{
+		"flag -oldname is deprecated: use -name instead",
+		"flag -other is deprecated: use -name instead",
+		"foo bar",
+		"foo",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestFlagAlias(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-v", "-name", "foo", "-n", "bar"}
+	arg[0] = "subcmd"
+	fs = flag.new("subcmd")
+	fs:bool("verbose", false, "Bool help string", {alias="v"})
+	fs:string("name", "", "String help string", {alias="n"})
+	flags = fs:parse(arg)
+
+	print(flags.verbose)
+	print(flags.v)
+	print(flags.name)
+	print(fs:set("verbose"))
+	print(fs:usage())
+	`
+
+	expected := strings.Join([]string{
+		"true",
+		"nil",
+		"bar",
+		"true",
+		"usage: subcmd [options]",
+		"  -name, -n string",
+		"    \tString help string",
+		"  -verbose, -v",
+		"    \tBool help string\n",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:int("times", 1, "Int help string")
+	fs:string("name", "foo", "String help string")
+	fs:string("title", "mr", "String help string")
+	fs:strings("tags", "Strings help string")
+	fs:defaults({times=5, name="bar", tags={"a", "b"}})
+
+	flags = fs:parse({[0] = "subcmd", "-name", "baz"})
+	print(flags.times .. " " .. flags.name .. " " .. flags.title .. " " .. table.concat(flags.tags, ","))
+
+	ok, err = pcall(function() fs:defaults({unknown=1}) end)
+	print(err)
+	ok, err = pcall(function() fs:defaults({times="many"}) end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"5 baz mr a,b",
+		"<string>:13: no such flag -unknown",
+		`<string>:15: invalid default value "many" for flag -times: parse error`,
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestNArgNFlag(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:int("x", 0, "Int help string")
+	fs:int("y", 0, "Int help string")
+
+	ok, err = pcall(function() fs:narg() end)
+	print(err)
+
+	fs:parse({[0] = "subcmd", "-x", "1", "a", "b"})
+	print(fs:narg())
+	print(fs:nflag())
+	`
+
+	expected := strings.Join([]string{
+		"<string>:7: narg called before parse",
+		"2",
+		"1",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestReset(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("name", "foo", "String help string")
+	fs:ints("times", "Ints help string")
+	fs:count("v", 0, "Count help string")
+	fs:bool("q", false, "Bool help string")
+
+	flags = fs:parse({[0] = "subcmd", "-name", "bar", "-times", "1", "-times", "2", "-v", "-q"})
+	print(flags.name .. " " .. table.concat(flags.times, ",") .. " " .. flags.v .. " " .. tostring(flags.q))
+
+	fs:reset()
+	flags = fs:parse({[0] = "subcmd", "-times", "3"})
+	print(flags.name .. " " .. table.concat(flags.times, ",") .. " " .. flags.v .. " " .. tostring(flags.q))
+	print(fs:set("name"))
+	print(fs:set("times"))
+	`
+
+	expected := strings.Join([]string{
+		"bar 1,2 1 true",
+		"foo 3 0 false",
+		"false",
+		"true",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCaseInsensitive(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-Verbose", "-NAME", "-Bar", "-FOO=Baz", "Pos"}
+	arg[0] = "subcmd"
+	fs = flag.new()
+	fs:bool("verbose", false, "Bool help string")
+	fs:string("name", "", "String help string")
+	fs:string("foo", "", "String help string")
+	fs:caseInsensitive(true)
+	flags = fs:parse(arg)
+
+	print(flags.verbose)
+	print(flags.name)
+	print(flags.foo)
+	print(flags[1])
+	`
+
+	expected := strings.Join([]string{
+		"true",
+		"-Bar",
+		"Baz",
+		"Pos",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestIgnoreUnknown(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-x", "-name", "foo", "--other=1", "-q", "bar", "-y"}
+	arg[0] = "subcmd"
+	fs = flag.new()
+	fs:string("name", "", "String help string")
+	fs:bool("q", false, "Bool help string")
+
+	ok, err = pcall(function() fs:parse(arg) end)
+	print(err)
+
+	fs:ignoreUnknown()
+	flags = fs:parse(arg)
+	print(flags.name)
+	print(flags.q)
+	print(table.concat(flags._unknown, " "))
+	print(table.concat(flags, " "))
+	`
+
+	expected := strings.Join([]string{
+		"<string>:9: flag provided but not defined: -x",
+		"foo",
+		"true",
+		"-x --other=1",
+		"bar -y",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("tool")
+	fs:bool("v", false, "Bool help string")
+	remote = fs:command("remote", flag.new("remote"))
+	add = remote:command("add", flag.new("add"))
+	add:string("name", "", "String help string")
+	add:stringArg("url", 1, "Url")
+	remote:command("remove", flag.new("remove"))
+
+	flags = fs:parse({[0] = "tool", "-v", "remote", "add", "-name", "origin", "http://example.com"})
+	print(flags.v)
+	print(flags.command)
+	print(flags.remote.command)
+	print(flags.remote.add.name)
+	print(flags.remote.add.url)
+
+	ok, err = pcall(function() fs:parse({[0] = "tool", "remote", "rename"}) end)
+	print(err)
+
+	print(pcall(function() fs:string("command", "", "String help string") end))
+	print(pcall(function() fs:stringArg("remote", "?", "Remote") end))
+	other = flag.new("other")
+	other:string("command", "", "String help string")
+	print(pcall(function() other:command("add", flag.new("add")) end))
+	print(pcall(function() fs:int("remote", 0, "Int help string") end))
+	`
+
+	expected := strings.Join([]string{
+		"true",
+		"remote",
+		"add",
+		"origin",
+		"http://example.com",
+		"<string>:18: remote: unknown command: rename",
+		"false\t<string>:21: flag \"command\" collides with the matched command",
+		"false\t<string>:22: argument \"remote\" collides with command \"remote\"",
+		"false\t<string>:25: command \"add\" collides with flag \"command\"",
+		"false\t<string>:26: flag \"remote\" collides with command \"remote\"",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCommandUsageOnError(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("tool")
+	fs:setOutput(function(s) out = out .. "tool: " .. s end)
+	add = fs:command("add", flag.new("add"))
+	add:string("name", "", "String help string")
+	add:setOutput(function(s) out = out .. "add: " .. s end)
+	add:usageOnError("short")
+
+	out = ""
+	ok, err = pcall(function() fs:parse({[0] = "tool", "add", "-missing"}) end)
+	print(err)
+	print(out)
+
+	fs:returnErrors()
+	flags, err = fs:parse({[0] = "tool", "add", "-name"})
+	print(err.kind, err.flag)
+	`
+
+	expected := strings.Join([]string{
+		"<string>:11: add: flag provided but not defined: -missing",
+		"add: usage: add [options]",
+		"",
+		"missing_value\tname",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestStringArg(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"test", "-name", "foo", "mr"}
+	fs = flag.new()
+	local function compgen()
+		return "fii foo fum"
+	end
+	fs:string("name", "foo", "String help string", compgen)
+	fs:stringArg("title", 1, "Title", function()
+		return "mr miss mrs"
+	end)
+	flags = fs:parse(arg)
+
+	function pairsByKeys(t)
+		local a = {}
+		for n in pairs(t) do table.insert(a, n) end
+		table.sort(a)
+		local i = 0			-- iterator variable
+		local iter = function ()	 -- iterator function
+			i = i + 1
+			if a[i] == nil then return nil
+			else return a[i], t[a[i]]
+			end
+		end
+		return iter
+	end
+
+	for k, v in pairsByKeys(flags) do
+		print(k .. " " .. v)
+	end
+	`
+
+	expected := strings.Join([]string{
+		"name foo",
+		"title mr",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestOptionalStringArg(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-name", "foo", "bar"}
+	arg[0] = "subcommand"
+	fs = flag.new()
+	fs:string("name", "foo", "String help string")
+	fs:stringArg("title", "?", "Title")
+	flags = fs:parse(arg)
+	assert(flags.title == "bar", "expected flags.title to be 'bar'")
+	`
+	doString(src, t)
+}
+
+func TestOptionalStringsArg(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-name", "foo", "bar"}
+	arg[0] = "subcommand"
+	fs = flag.new()
+	fs:string("name", "foo", "String help string")
+	fs:stringArg("title", "*", "Title")
+	flags = fs:parse(arg)
+	assert(type(flags.title) == "table", "expected flags.title to be a 'table'")
+	assert(#flags.title == 1, "expected flags.title to have length == 1")
+	assert(flags.title[1] == "bar", "expected flags.title[1] to be 'bar'")
+	`
+	doString(src, t)
+}
+
+func TestStringsArg(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-name", "foo", "bar"}
+	arg[0] = "subcommand"
+	fs = flag.new()
+	fs:string("name", "foo", "String help string")
+	fs:stringArg("title", "+", "Title")
+	flags = fs:parse(arg)
+	assert(type(flags.title) == "table", "expected flags.title to be a 'table'")
+	assert(#flags.title == 1, "expected flags.title to have length == 1")
+	assert(flags.title[1] == "bar", "expected flags.title[1] to be 'bar'")
+	`
+	doString(src, t)
+}
+
+func TestStringsArgToFew(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-name", "foo"}
+	arg[0] = "subcommand"
+	fs = flag.new()
+	fs:string("name", "foo", "String help string")
+	fs:stringArg("title", "+", "Title")
+	ok, err = pcall(function() fs:parse(arg) end)
+	print(err)
+	`
+	expected := "<string>:8: argument title: expected at least one string"
+	stdout, _ := doString(src, t)
+	if stdout != expected {
+		t.Errorf("expected: `%v`\ngot: `%v`\nsrc: `%v`", expected, stdout, src)
+	}
+}
+
+func TestNStringsArgument(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-name", "foo", "bar", "baz"}
+	arg[0] = "subcommand"
+	fs = flag.new()
+	fs:string("name", "foo", "String help string")
+	fs:stringArg("title", 2, "Title")
+	flags = fs:parse(arg)
+	assert(type(flags.title) == "table", "expected flags.title to be a 'table'")
+	assert(#flags.title == 2, "expected flags.title to have length == 1")
+	assert(flags.title[1] == "bar", "expected flags.title[1] to be 'bar'")
+	assert(flags.title[2] == "baz", "expected flags.title[1] to be 'baz'")
+	`
+	doString(src, t)
+}
+
+func TestNStringsArgToFew(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-name", "foo", "bar"}
+	arg[0] = "subcommand"
+	fs = flag.new()
+	fs:string("name", "foo", "String help string")
+	fs:stringArg("title", 2, "Title")
+	ok, err = pcall(function() fs:parse(arg) end)
+	print(err)
+	`
+	expected := "<string>:8: argument title: expected 2 strings"
+	stdout, _ := doString(src, t)
+	if stdout != expected {
+		t.Errorf("expected: `%v`\ngot: `%v`\nsrc: `%v`", expected, stdout, src)
+	}
+}
+
+func TestRangeStringsArgument(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("subcommand")
+	fs:stringArg("file", {min=2, max=3}, "Files")
+
+	flags = fs:parse({[0] = "subcommand", "a", "b"})
+	print(table.concat(flags.file, " "))
+	flags = fs:parse({[0] = "subcommand", "a", "b", "c"})
+	print(table.concat(flags.file, " "))
+	ok, err = pcall(function() fs:parse({[0] = "subcommand", "a"}) end)
+	print(err)
+	ok, err = pcall(function() fs:stringArg("bad", {min=3, max=2}, "Bad") end)
+	print(err)
+	print(fs:usage())
+	`
+
+	expected := strings.Join([]string{
+		"a b",
+		"a b c",
+		"<string>:10: argument file: expected between 2 and 3 strings",
+		"<string>:12: nargs range min should not exceed max",
+		"usage: subcommand file{2,3} ",
+		"  file{2,3} string",
+		"    \tFiles\n",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCollectRest(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"file", "dest", "extra1", "extra2"}
+	arg[0] = "subcommand"
+	fs = flag.new()
+	fs:stringArg("file", 1, "File")
+	fs:stringArg("dest", 1, "Destination")
+
+	ok, err = pcall(function() fs:parse(arg) end)
+	print(err)
+
+	fs:collectRest()
+	flags = fs:parse(arg)
+	print(flags.file .. " " .. flags.dest .. " " .. table.concat(flags.rest, " "))
+	flags = fs:parse({[0] = "subcommand", "file", "dest"})
+	print(#flags.rest)
+	`
+
+	expected := strings.Join([]string{
+		"<string>:9: unknown argument: [extra1 extra2]",
+		"file dest extra1 extra2",
+		"0",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("name", "x", "Name", {validate=function(v) return v ~= "" or "must not be empty" end})
+	fs:ints("port", "Ports", {validate=function(v) return v > 0 end})
+
+	flags = fs:parse({[0] = "cmd", "-port", "1", "-port", "2"})
+	print(flags.name .. " " .. table.concat(flags.port, " "))
+
+	fs:reset()
+	ok, err = pcall(function() fs:parse({[0] = "cmd", "-name="}) end)
+	print(err)
+
+	fs:reset()
+	ok, err = pcall(function() fs:parse({[0] = "cmd", "-port", "1", "-port", "-2"}) end)
+	print(err)
+
+	fs = flag.new()
+	fs:number("ratio", 0, "Ratio", {validate=function(v) error("boom") end})
+	ok, err = pcall(function() fs:parse({[0] = "cmd"}) end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"x 1 2",
+		"<string>:11: invalid value \"\" for flag -name: must not be empty",
+		"<string>:15: invalid value \"-2\" for flag -port: validation failed",
+		"<string>:20: invalid value \"0\" for flag -ratio: <string>:19: boom",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestDefaultValue(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:int("port", 8080, "Port")
+	fs:string("host", "localhost", "Host", {alias="H"})
+	fs:ints("ids", "Ids")
+
+	fs:parse({[0] = "cmd", "-port", "1", "-H", "example.com"})
+	print(fs:default("port") + 1, type(fs:default("port")))
+	print(fs:default("host"), type(fs:default("H")))
+	print(#fs:default("ids"))
+
+	fs:defaults({ids={1, 2}})
+	print(table.concat(fs:default("ids"), " "))
+
+	ok, err = pcall(function() fs:default("missing") end)
+	print(err)
+
+	fs:reset()
+	print(table.concat(fs:parseArgs({"-ids", "5"}).ids, " "))
+	fs:reset()
+	print(table.concat(fs:parseArgs({}).ids, " "))
+	fs:defaults({ids={3}})
+	fs:reset()
+	print(table.concat(fs:parseArgs({}).ids, " "))
+	`
+
+	expected := strings.Join([]string{
+		"8081\tnumber",
+		"localhost\tstring",
+		"0",
+		"1 2",
+		"<string>:16: no such flag -missing",
+		"5",
+		"1 2",
+		"3",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestSplitSliceFlags(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:strings("tags", "Tags", {split=true})
+	fs:ints("ids", "Ids", {split=true})
+	fs:strings("raw", "Raw")
+
+	flags = fs:parse({[0] = "cmd", "-tags", "a,b", "-tags", "c", "-ids", "1,2", "-raw", "x,y"})
+	print(table.concat(flags.tags, " "), #flags.tags)
+	print(flags.ids[1] + flags.ids[2])
+	print(table.concat(flags.raw, " "), #flags.raw)
+
+	fs:reset()
+	ok, err = pcall(function() fs:parse({[0] = "cmd", "-ids", "1,x"}) end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"a b c\t3",
+		"3",
+		"x,y\t1",
+		"<string>:14: invalid value \"1,x\" for flag -ids: strconv.Atoi: parsing \"x\": invalid syntax",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestFlagUsage(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:ints("port", "Ports to listen on")
+	fs:bool("v", false, "Verbose")
+	fs:string("name", "world", "Name", {alias="n"})
+
+	print(fs:flagUsage("port"))
+	print(fs:flagUsage("v"))
+	print(fs:flagUsage("n"))
+	ok, err = pcall(function() fs:flagUsage("missing") end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"  -port value",
+		"    \tPorts to listen on",
+		"  -v\tVerbose",
+		"  -name, -n string",
+		"    \tName (default \"world\")",
+		"<string>:11: no such flag -missing",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestArgumentDefault(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("cmd")
+	fs:stringArg("dir", "?", "Target", nil, {default="."})
+	fs:intArg("n", "?", "Count", nil, {default=3})
+
+	flags = fs:parse({[0] = "cmd"})
+	print(flags.dir, flags.n)
+	flags = fs:parse({[0] = "cmd", "/tmp", "5"})
+	print(flags.dir, flags.n)
+	print(fs:usage())
+
+	print(pcall(function() fs:intArg("m", "?", "Count", nil, {default=1.5}) end))
+	print(pcall(function() fs:stringArg("s", "?", "Name", nil, {default=3}) end))
+	print(pcall(function() fs:numberArg("sizes", "*", "Sizes", nil, {default=1}) end))
+	print(pcall(function() fs:numberArg("sizes", "*", "Sizes", nil, {default={1, "x"}}) end))
+	fs:numberArg("sizes", "*", "Sizes", nil, {default={1, 2.5}})
+	print(table.concat(fs:parse({[0] = "cmd"}).sizes, " "))
+	`
+
+	expected := strings.Join([]string{
+		".\t3",
+		"/tmp\t5",
+		"usage: cmd [dir]  [n] ",
+		"  dir string",
+		"    \tTarget (default \".\")",
+		"  n int",
+		"    \tCount (default 3)",
+		"",
+		"false\t<string>:13: bad argument #6 to intArg (m: invalid int default: 1.5)",
+		"false\t<string>:14: bad argument #6 to stringArg (s: invalid string default: 3)",
+		"false\t<string>:15: bad argument #6 to numberArg (sizes: default must be a table)",
+		"false\t<string>:16: bad argument #6 to numberArg (sizes: invalid number default: x)",
+		"1 2.5",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestResponseFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gluaflag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	nested := filepath.Join(dir, "nested.txt")
+	args := filepath.Join(dir, "args.txt")
+	if err := ioutil.WriteFile(nested, []byte("-verbose\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(args, []byte("-name foo\n-count 3 @"+nested+"\nfile.txt\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("name", "", "Name")
+	fs:int("count", 0, "Count")
+	fs:bool("verbose", false, "Verbose")
+	fs:responseFiles()
+
+	flags = fs:parse({[0] = "cmd", "@` + args + `", "other.txt"})
+	print(flags.name, flags.count, flags.verbose, flags[1], flags[2])
+
+	ok, err = pcall(function() fs:parse({[0] = "cmd", "@` + dir + `/missing.txt"}) end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"foo\t3\ttrue\tfile.txt\tother.txt",
+		"<string>:12: reading response file: open " + dir + "/missing.txt: no such file or directory",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestParseErrorKinds(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:setOutput(function() end)
+	fs:int("count", 0, "Count", {required=true})
+	fs:string("name", "", "Name", {validate=function(v) return v ~= "bad" end})
+	fs:returnErrors()
+
+	for _, args in ipairs({
+		{"-count", "1", "-missing"},
+		{"-count"},
+		{"-count", "x"},
+		{"-name", "x"},
+		{"-count", "1", "-name", "bad"},
+	}) do
+		fs:reset()
+		args[0] = "cmd"
+		flags, err = fs:parse(args)
+		print(flags, err.kind, err.message)
+	end
+
+	fs:returnErrors(false)
+	fs:reset()
+	ok, err = pcall(function() fs:parse({[0] = "cmd"}) end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"nil\tunknown_flag\tflag provided but not defined: -missing",
+		"nil\tmissing_value\tflag needs an argument: -count",
+		"nil\tinvalid_value\tinvalid value \"x\" for flag -count: parse error",
+		"nil\tmissing_required\tflag -count is required",
+		"nil\tvalidation\tinvalid value \"bad\" for flag -name: validation failed",
+		"<string>:24: flag -count is required",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestAbbreviations(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:bool("verbose", false, "Verbose")
+	fs:bool("version", false, "Version")
+	fs:string("name", "", "Name")
+	fs:abbreviations()
+
+	flags = fs:parse({[0] = "cmd", "-verb", "-na", "foo", "file"})
+	print(flags.verbose, flags.version, flags.name, flags[1])
+
+	fs:reset()
+	flags = fs:parse({[0] = "cmd", "--n=bar"})
+	print(flags.name)
+
+	fs:reset()
+	ok, err = pcall(function() fs:parse({[0] = "cmd", "-ver"}) end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"true\tfalse\tfoo\tfile",
+		"bar",
+		"<string>:17: ambiguous flag -ver: could be -verbose, -version",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestPositionals(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:stringArg("src", 1, "Source")
+	fs:intArg("count", 1, "Count")
+	fs:collectRest()
+
+	flags = fs:parse({[0] = "cmd", "a.txt", "3", "x", "y"})
+	for i, p in ipairs(fs:positionals(flags)) do
+		print(i, p.name, p.value)
+	end
+	print(#fs:positionals(flags), table.concat(flags.rest, " "))
+	`
+
+	expected := strings.Join([]string{
+		"1\tsrc\ta.txt",
+		"2\tcount\t3",
+		"2\tx y",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCustomFlag(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("cmd")
+	fs:custom("color", "Color", {
+		default = "RED",
+		set = function(s, current)
+			if s == "" then
+				return nil, "empty color"
+			end
+			return string.upper(s)
+		end,
+		string = function(v) return v:lower() end,
+	})
+
+	flags = fs:parse({[0] = "cmd"})
+	print(flags.color)
+	flags = fs:parse({[0] = "cmd", "-color", "blue"})
+	print(flags.color)
+	print(fs:flagUsage("color"))
+
+	fs:reset()
+	ok, err = pcall(function() fs:parse({[0] = "cmd", "-color="}) end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"RED",
+		"BLUE",
+		"  -color value",
+		"    \tColor (default red)",
+		"<string>:22: invalid value \"\" for flag -color: empty color",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestProgramName(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:stringArg("src", 1, "Source", function() return "a.txt" end)
+	fs:stringArg("dst", 1, "Destination", function() return "b.txt" end)
+
+	flags = fs:parse({[0] = "cmd", "x", "y"})
+	print(flags.src, flags.dst)
+	flags = fs:parse({"cmd", "x", "y"})
+	print(flags.src, flags.dst)
+
+	print(table.concat(fs:compgen(2, {[0] = "cmd", "x", ""}), " "))
+	print(table.concat(fs:compgen(2, {"cmd", "x", ""}), " "))
+
+	arg = {"prog"}
+	print(flag.new():usage())
+	arg = {[0] = "prog0", "x"}
+	print(flag.new():usage())
+	`
+
+	expected := strings.Join([]string{
+		"x\ty",
+		"x\ty",
+		"b.txt",
+		"b.txt",
+		"usage: prog",
+		"",
+		"usage: prog0",
+		"",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:int("count", 0, "Count", {required=true})
+	fs:setOutput(function(s) out = s end)
+
+	print(fs:validate({[0] = "cmd", "-count", "2"}))
+	print(fs:validate({[0] = "cmd", "-count", "x"}))
+	print(fs:validate({[0] = "cmd"}))
+	print(out)
+
+	flags = fs:parse({[0] = "cmd", "-count", "3"})
+	print(flags.count)
+	`
+
+	expected := strings.Join([]string{
+		"true",
+		"false\tinvalid value \"x\" for flag -count: parse error",
+		"false\tflag -count is required",
+		"nil",
+		"3",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestValidateAfterParse(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:int("count", 0, "Count", {required=true})
+	fs:strings("tags", "Tags")
+
+	flags = fs:parseArgs({"-count", "3", "-tags", "a"})
+	print(fs:validate({[0] = "cmd"}))
+	print(fs:validate({[0] = "cmd", "-count", "1", "-tags", "b"}))
+	print(fs:set("count"))
+
+	fs:reset()
+	flags = fs:parseArgs({"-count", "4", "-tags", "c"})
+	print(flags.count, table.concat(flags.tags, " "))
+	`
+
+	expected := strings.Join([]string{
+		"false\tflag -count is required",
+		"true",
+		"true",
+		"4\tc",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestNegativeNumbers(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:number("offset", 0, "Offset")
+	fs:numberArg("delta", 1, "Delta")
+
+	flags = fs:parse({[0] = "cmd", "-offset", "-5", "-3.14"})
+	print(flags.offset, flags.delta)
+	fs:reset()
+	flags = fs:parse({[0] = "cmd", "-offset=-3.14", "-5"})
+	print(flags.offset, flags.delta)
+
+	words = flag.new()
+	words:bool("v", false, "Verbose")
+	words:stringArg("word", "?", "Word")
+	print(pcall(function() words:parseArgs({"-1", "-v"}) end))
+
+	counts = flag.new()
+	counts:int("number", 0, "Number")
+	counts:intArg("delta", 1, "Delta")
+	counts:caseInsensitive()
+	counts:abbreviations()
+	for _, args in ipairs({{"-NUMBER", "3", "-5"}, {"-numb", "3", "-5"}}) do
+		counts:reset()
+		flags = counts:parseArgs(args)
+		print(flags.number, flags.delta)
+	end
+	`
+
+	expected := strings.Join([]string{
+		"-5\t-3.14",
+		"-3.14\t-5",
+		"false\t<string>:16: flag provided but not defined: -1",
+		"3\t-5",
+		"3\t-5",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestUnitSuffixes(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:int("size", 0, "Size", {units=true})
+	fs:number("rate", 0, "Rate", {units=1000})
+	fs:int("count", 0, "Count", {units=1000})
+
+	flags = fs:parse({[0] = "cmd", "-size", "1k", "-rate", "2M", "-count", "1_000"})
+	print(flags.size, flags.rate, flags.count)
+
+	fs:reset()
+	ok, err = pcall(function() fs:parse({[0] = "cmd", "-size", "5x"}) end)
+	print(err)
+
+	print(pcall(function() fs:int("mask", 0, "Mask", {units=true, base=16}) end))
+	`
+
+	expected := strings.Join([]string{
+		"1024\t2000000\t1000",
+		"<string>:12: invalid value \"5x\" for flag -size: unknown unit suffix \"x\"",
+		"false\t<string>:15: bad argument #5 to int (units can not be combined with base)",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestStdinArgument(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:bool("v", false, "Verbose")
+	fs:stringArg("input", 1, "Input file", function(word) return flag.files(word) end)
+	fs:stringArg("output", 1, "Output file")
+
+	flags = fs:parse({[0] = "cmd", "-v", "-", "out.txt"})
+	print(flags.v, flags.input, flags.output)
+	print(flag.files("-"))
+	`
+
+	expected := strings.Join([]string{
+		"true\t-\tout.txt",
+		"-",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestFlagType(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:number("number", 0, "")
+	fs:numbers("numbers", "")
+	fs:float32("float32", 0, "")
+	fs:float32s("float32s", "")
+	fs:int("int", 0, "")
+	fs:int64("int64", 0, "")
+	fs:uint("uint", 0, "")
+	fs:uint64("uint64", 0, "")
+	fs:ints("ints", "")
+	fs:string("string", "", "", {alias="s"})
+	fs:strings("strings", "")
+	fs:duration("duration", 0, "")
+	fs:durations("durations", "")
+	fs:keyvalue("keyvalue", "")
+	fs:bool("bool", false, "")
+	fs:bools("bools", "")
+	fs:count("count", 0, "")
+	fs:choice("choice", "a", {"a", "b"}, "")
+	fs:custom("custom", "", {set=function(s) return s end})
+
+	for _, name in ipairs({"number", "numbers", "float32", "float32s", "int", "int64", "uint", "uint64",
+		"ints", "string", "strings", "duration", "durations", "keyvalue", "bool", "bools", "count",
+		"choice", "custom"}) do
+		assert(fs:flagType(name) == name, name .. ": got " .. fs:flagType(name))
+	end
+	print(fs:flagType("s"))
+	ok, err = pcall(function() fs:flagType("missing") end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"string",
+		"<string>:30: no such flag -missing",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestGroupUsage(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("cmd")
+	fs:string("log-level", "info", "Log level")
+	fs:string("db-host", "", "Database host")
+	fs:int("db-port", 5432, "Database port")
+	fs:bool("verbose", false, "Verbose")
+	fs:groupUsage()
+	print(fs:usage())
+	`
+
+	expected := strings.Join([]string{
+		"usage: cmd [options]",
+		"  -verbose",
+		"    \tVerbose",
+		"",
+		"db:",
+		"  -db-host string",
+		"    \tDatabase host",
+		"  -db-port int",
+		"    \tDatabase port (default 5432)",
+		"",
+		"log:",
+		"  -log-level string",
+		"    \tLog level (default \"info\")",
+		"",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCollectErrors(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("name", "", "Name", {validate=function(v) return v ~= "" or "must not be empty" end})
+	fs:int("port", 0, "Port", {validate=function(v) return v > 0 or "must be positive" end})
+	fs:string("host", "", "Host", {required=true})
+
+	ok, err = pcall(function() fs:parse({[0] = "cmd"}) end)
+	print(err)
+
+	fs:collectErrors()
+	ok, err = pcall(function() fs:parse({[0] = "cmd"}) end)
+	print(err)
+
+	fs:returnErrors()
+	flags, err = fs:parse({[0] = "cmd", "-host", "h"})
+	print(err.kind, #err.errors, err.errors[1].kind, err.errors[2].message)
+	`
+
+	expected := strings.Join([]string{
+		"<string>:8: flag -host is required",
+		"<string>:12: flag -host is required",
+		"invalid value \"\" for flag -name: must not be empty",
+		"invalid value \"0\" for flag -port: must be positive",
+		"multiple\t2\tvalidation\tinvalid value \"0\" for flag -port: must be positive",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestHelpRequested(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("cmd")
+	fs:string("name", "", "Name")
+	fs:setOutput(function(s) out = s end)
+
+	flags, help = fs:parse({[0] = "cmd", "-h"})
+	print(flags, help.helpRequested)
+	print(help.usage .. tostring(out))
+
+	fs:reset()
+	flags, help = fs:parse({[0] = "cmd", "-name", "foo"})
+	print(flags.name, help)
+	`
+
+	expected := strings.Join([]string{
+		"nil\ttrue",
+		"usage: cmd [options]",
+		"  -name string",
+		"    \tName",
+		"nil",
+		"foo\tnil",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestClone(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("cmd")
+	fs:string("name", "world", "Name", {alias="n"})
+	fs:ints("ids", "Ids")
+	fs:int("port", 80, "Port", {min=1})
+	fs:stringArg("file", "?", "File")
+
+	a = fs:clone()
+	b = fs:clone()
+	fa = a:parse({[0] = "cmd", "-n", "alice", "-ids", "1", "a.txt"})
+	fb = b:parse({[0] = "cmd", "-ids", "2", "-ids", "3", "-port", "8080"})
+	print(fa.name, table.concat(fa.ids, " "), fa.port, fa.file)
+	print(fb.name, table.concat(fb.ids, " "), fb.port, fb.file)
+
+	f = fs:parse({[0] = "cmd"})
+	print(f.name, #f.ids, f.port, f.file)
+
+	ok, err = pcall(function() a:clone():parse({[0] = "cmd", "-port", "0"}) end)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"alice\t1\t80\ta.txt",
+		"world\t2 3\t8080\tnil",
+		"world\t0\t80\tnil",
+		"<string>:19: invalid value \"0\" for flag -port: port: 0 is below min 1",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestStringArgumentCompgen(t *testing.T) {
+	src := `
+	local flag = require('flag')
+
+	fs = flag.new("subcommand")
+	local function compgen()
+		return "fii", "foo", "fum"
+	end
+
+	res = {}
+	fs:string("name", "foo", "String help string", compgen)
+	fs:stringArg("mr", 1, "Title", function(arg, flags, raw)
+		res.arg = arg
+		res.flags = flags
+		res.raw = raw
+		return "mr", "miss", "mrs"
+	end)
+
+	local arg = {"-name", "foo", "m"}
+	arg[0] = "subcommand"
+	flags = fs:compgen(3, arg)
+	assert(res.arg == "m", "expected arg to be 'm', got " .. res.arg)
+	assert(res.flags.name == "foo", "expected flag.names to be 'foo', got " .. res.flags.name)
+	assert(res.raw[0] == "subcommand", "expected raw[0] to be 'subcommand', got " .. res.raw[0])
+	assert(res.raw[1] == "-name", "expected raw[1] to be '-name', got " .. res.raw[1])
+
+	print(table.concat(flags, " "))
+
+	`
+
+	expected := strings.Join([]string{
+		"mrs",
+		"miss",
+		"mr",
+	}, " ")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TeststringArgumentCompgen2(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-name", "foo", "m"}
+	arg[0] = "subcommand"
+	fs = flag.new()
+	local function compgen()
+		return "fii foo fum"
+	end
+	fs:string("name", "foo", "String help string", compgen)
+	fs:stringArgument("mr", 1, "Title", function()
+		return "mr miss mrs"
+	end)
+	flags = fs:compgen(3, arg)
+
+	print(flags)
+	`
+
+	expected := strings.Join([]string{
+		"mr",
+		"miss",
+		"mrs",
+	}, " ")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCommandCompgen(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("tool")
+	fs:string("config", "", "String help string")
+	remote = fs:command("remote", flag.new("remote"))
+	fs:command("status", flag.new("status"))
+	add = remote:command("add", flag.new("add"))
+	add:string("name", "", "String help string", function()
+		return "origin upstream"
+	end)
+	remote:command("remove", flag.new("remove"))
+
+	local arg = {[0] = "tool"}
+	print(table.concat(fs:compgen(1, arg), " "))
+	arg = {[0] = "tool", "-config", "foo", "st"}
+	print(table.concat(fs:compgen(3, arg), " "))
+	arg = {[0] = "tool", "remote"}
+	print(table.concat(fs:compgen(2, arg), " "))
+	arg = {[0] = "tool", "remote", "add", "-name"}
+	print(table.concat(fs:compgen(4, arg), " "))
+	`
+
+	expected := strings.Join([]string{
+		"remote status",
+		"remote status",
+		"add remove",
+		"origin upstream",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCompgenEmptyWord(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("subcommand")
+	fs:bool("q", false, "Bool help string")
+	fs:string("name", "foo", "String help string")
+
+	local arg = {"-q", ""}
+	arg[0] = "subcommand"
+	print(table.concat(fs:compgen(2, arg), " "))
+
+	arg = {"", "-"}
+	arg[0] = "subcommand"
+	print(table.concat(fs:compgen(2, arg), " "))
+	`
+
+	expected := strings.Join([]string{
+		"",
+		"-name -q",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCompgenError(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("subcommand")
+	fs:string("name", "foo", "String help string", function()
+		error("flag failure")
+	end)
+	fs:stringArg("title", 1, "Title", function()
+		error("argument failure")
+	end)
+
+	local arg = {"-name"}
+	arg[0] = "subcommand"
+	ok, err = pcall(function() return fs:compgen(2, arg) end)
+	print(ok)
+	print(err)
+
+	arg = {"-name", "foo", "m"}
+	arg[0] = "subcommand"
+	ok, err = pcall(function() return fs:compgen(3, arg) end)
+	print(ok)
+	print(err)
+	`
+
+	expected := strings.Join([]string{
+		"false",
+		"<string>:5: flag failure",
+		"false",
+		"<string>:8: argument failure",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestOrderedUsage(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("subcommand")
+	fs:int("c", 0, "C help string")
+	fs:int("a", 0, "A help string")
+	fs:int("b", 0, "B help string")
+	fs:orderedUsage()
+
+	print(fs:usage())
+	`
+
+	expected := strings.Join([]string{
+		"usage: subcommand [options]",
+		"  -c int",
+		"    \tC help string",
+		"  -a int",
+		"    \tA help string",
+		"  -b int",
+		"    \tB help string\n",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected stdout: `%v`\ngot: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestCustomUsage(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("subcommand")
+	fs:int("times", 1, "Int help string")
+	fs:string("name", "", "String help string", {required=true})
+	fs:stringArg("title", "?", "Title")
+	fs:setUsage(function(u)
+		local lines = {"Usage of " .. u.name .. ": " .. u.short}
+		for _, f in ipairs(u.flags) do
+			table.insert(lines, string.format("--%s <%s> %s [%s]%s", f.name, f.type, f.usage, f.default, f.required and " (required)" or ""))
+		end
+		for _, a in ipairs(u.arguments) do
+			table.insert(lines, a.name .. ": " .. a.usage)
+		end
+		return table.concat(lines, "\n")
+	end)
+
+	print(fs:usage())
+	fs:sortFlags(false)
+	print(fs:usage())
+	`
+
+	expected := strings.Join([]string{
+		"Usage of subcommand: subcommand [options] [title] ",
+		"--name <string> String help string [] (required)",
+		"--times <int> Int help string [1]",
+		"title: Title",
+		"Usage of subcommand: subcommand [options] [title] ",
+		"--times <int> Int help string [1]",
+		"--name <string> String help string [] (required)",
+		"title: Title",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected stdout: `%v`\ngot: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestSetUsageFunc(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	var custom, builtin string
+	_, err := ParseArgs(L, "cmd", []string{}, func(fs *FlagSet) {
+		fs.SetUsageFunc(func(fs *FlagSet) string {
+			return "usage of " + fs.ShortUsage()
+		})
+		custom = fs.Usage()
+		fs.SetUsageFunc(nil)
+		builtin = fs.Usage()
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "usage of cmd"; custom != expected {
+		t.Errorf("expected: `%v`, got: `%v`", expected, custom)
+	}
+	if expected := "usage: cmd\n"; builtin != expected {
+		t.Errorf("expected: `%v`, got: `%v`", expected, builtin)
+	}
+}
+
+func TestSortFlags(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("subcommand")
+	fs:bool("z", false, "Z help string")
+	fs:bool("y", false, "Y help string")
+	fs:bool("x", false, "X help string")
+
+	print(fs:usage())
+	fs:sortFlags(false)
+	print(fs:usage())
+	fs:sortFlags(true)
+	print(fs:usage())
+	`
+
+	sorted := strings.Join([]string{
+		"usage: subcommand [options]",
+		"  -x\tX help string",
+		"  -y\tY help string",
+		"  -z\tZ help string\n",
+	}, "\n")
+	declared := strings.Join([]string{
+		"usage: subcommand [options]",
+		"  -z\tZ help string",
+		"  -y\tY help string",
+		"  -x\tX help string\n",
+	}, "\n")
+	expected := strings.Join([]string{sorted, declared, sorted}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected stdout: `%v`\ngot: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestUsageWidth(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("subcommand")
+	fs:string("name", "foo", "The name used when greeting somebody in the output, supercalifragilisticexpialidocious")
+	fs:stringArg("title", 1, "The title used when greeting somebody")
+	fs:usageWidth(40)
+
+	print(fs:usage())
+	`
+
+	expected := strings.Join([]string{
+		"usage: subcommand [options] title ",
+		"  -name string",
+		"    \tThe name used when greeting",
+		"    \tsomebody in the output,",
+		"    \tsupercalifragilisticexpialidocious",
+		"    \t(default \"foo\")",
+		"  title string",
+		"    \tThe title used when greeting",
+		"    \tsomebody\n",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected stdout: `%v`\ngot: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestStringArgumentUsage(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("subcommand")
+	fs:stringArg("title", 1, "Your title")
+
+	print(fs:usage())
+	`
+
+	expected := strings.Join([]string{
+		"usage: subcommand title ",
+		"  title string",
+		"    \tYour title\n",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected stdout: `%v`\ngot: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestFlagsAndArguments(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	L.PreloadModule("flag", Loader)
+
+	src := `
+	local flag = require('flag')
+	fs = flag.new("subcommand")
+	fs:string("name", "foo", "String help string", {required=true})
+	fs:ints("times", "Ints help string", {alias="t"})
+	fs:bool("q", false, "Bool help string")
+	fs:stringArg("title", 1, "Title")
+	fs:intArg("size", "?", "Size", nil, {default=3})
+	fs:intArg("sizes", "*", "Sizes")
+	`
+	if err := L.DoString(src); err != nil {
+		t.Fatalf("runtime error: %v", err)
+	}
+	fs := L.GetGlobal("fs").(*lua.LUserData).Value.(*FlagSet)
+
+	expectedFlags := []FlagInfo{
+		{Name: "name", Type: "string", Usage: "String help string", Default: "foo", Required: true},
+		{Name: "times", Alias: "t", Type: "ints", Usage: "Ints help string", Default: "[]", Slice: true},
+		{Name: "q", Type: "bool", Usage: "Bool help string", Default: "false"},
+	}
+	if flags := fs.Flags(); !reflect.DeepEqual(flags, expectedFlags) {
+		t.Errorf("expected: `%+v`, got: `%+v`", expectedFlags, flags)
+	}
+
+	expectedArgs := []ArgInfo{
+		{Name: "title", Type: "string", Usage: "Title"},
+		{Name: "size", Type: "int", Usage: "Size", Default: "3"},
+		{Name: "sizes", Type: "int", Usage: "Sizes", Slice: true},
+	}
+	if args := fs.Arguments(); !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("expected: `%+v`, got: `%+v`", expectedArgs, args)
+	}
+}
+
+func TestSliceFlagDefaults(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:strings("tags", "Tags", {default={"a", "b"}})
+	fs:ints("ids", "Ids", {default={1, 2}, alias="i"})
+
+	flags = fs:parse({[0] = "cmd"})
+	print(table.concat(flags.tags, " "), table.concat(flags.ids, " "))
+
+	fs:reset()
+	flags = fs:parse({[0] = "cmd", "-tags", "c", "-tags", "d", "-i", "3"})
+	print(table.concat(flags.tags, " "), table.concat(flags.ids, " "))
+
+	fs:reset()
+	flags = fs:parse({[0] = "cmd"})
+	print(table.concat(flags.tags, " "), table.concat(flags.ids, " "))
+
+	print(fs:flagUsage("tags"))
+	`
+
+	expected := strings.Join([]string{
+		"a b\t1 2",
+		"c d\t3",
+		"a b\t1 2",
+		"  -tags value",
+		"    \tTags (default [a b])",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestBoolSliceFlagDefaults(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:bools("b", "Bools", {default={"false"}})
+	fs:stringArg("file", "?", "File")
+
+	flags = fs:parseArgs({})
+	print(#flags.b, flags.b[1], flags.file)
+
+	fs:reset()
+	flags = fs:parseArgs({"-b", "x"})
+	print(#flags.b, flags.b[1], flags.file)
+	`
+
+	expected := strings.Join([]string{
+		"1\tfalse\tnil",
+		"1\ttrue\tx",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestSliceFlagAppendDefaults(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:strings("tag", "Tags", {default={"a"}, appendDefaults=true})
+	fs:strings("label", "Labels", {default={"a"}})
+
+	flags = fs:parseArgs({"-tag", "b", "-label", "b"})
+	print(table.concat(flags.tag, " "), table.concat(flags.label, " "))
+
+	fs:reset()
+	flags = fs:parseArgs({})
+	print(table.concat(flags.tag, " "), table.concat(flags.label, " "))
+
+	c = fs:clone()
+	flags = c:parseArgs({"-tag", "c", "-tag", "d"})
+	print(table.concat(flags.tag, " "))
+	`
+
+	expected := strings.Join([]string{
+		"a b\tb",
+		"a\ta",
+		"a c d",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestRestArg(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:bool("v", false, "Verbose")
+	fs:stringArg("cmd", 1, "Command")
+	fs:restArg("args", "Arguments to the command")
+
+	flags = fs:parse({[0] = "exec", "-v", "ls", "-x", "--all", "dir"})
+	print(flags.v, flags.cmd, table.concat(flags.args, " "))
+
+	fs:reset()
+	flags = fs:parse({[0] = "exec", "--", "-x", "-y", "--", "z"})
+	print(flags.v, flags.cmd, table.concat(flags.args, " "))
+
+	fs:reset()
+	flags = fs:parse({[0] = "exec", "ls"})
+	print(flags.cmd, #flags.args)
+	`
+
+	expected := strings.Join([]string{
+		"true\tls\t-x --all dir",
+		"false\t-x\t-y -- z",
+		"ls\t0",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestGoFlagSet(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	L.PreloadModule("flag", Loader)
+
+	if err := L.DoString(`
+	local flag = require('flag')
+	fs = flag.new("cmd")
+	fs:string("name", "", "Name")
+	`); err != nil {
+		t.Fatalf("runtime error: %v", err)
+	}
+	fs := L.GetGlobal("fs").(*lua.LUserData).Value.(*FlagSet)
+	port := fs.GoFlagSet().Int("port", 80, "Port")
+
+	src := `
+	flags = fs:parse({[0] = "cmd", "-port", "8080", "-name", "foo"})
+	result = flags.name .. " " .. flags.port .. " " .. type(flags.port)
+	`
+	if err := L.DoString(src); err != nil {
+		t.Fatalf("runtime error: %v", err)
+	}
+
+	expected := "foo 8080 string"
+	if got := L.GetGlobal("result").String(); got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+	if *port != 8080 {
+		t.Errorf("expected: `%v`, got: `%v`", 8080, *port)
+	}
+
+	goFlags := fs.GoFlagSet()
+	if err := fs.Reset(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fs.GoFlagSet() != goFlags {
+		t.Errorf("expected the same flag set after Reset")
+	}
+	if *port != 80 {
+		t.Errorf("expected: `%v`, got: `%v`", 80, *port)
+	}
+	late := goFlags.Bool("late", false, "Late")
+	if err := L.DoString(`flags = fs:parse({[0] = "cmd", "-late", "-port", "81"})`); err != nil {
+		t.Fatalf("runtime error: %v", err)
+	}
+	if !*late || *port != 81 {
+		t.Errorf("expected: `true 81`, got: `%v %v`", *late, *port)
+	}
+}
+
+func TestCloneGoFlags(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	L.PreloadModule("flag", Loader)
+
+	if err := L.DoString(`
+	local flag = require('flag')
+	fs = flag.new("cmd")
+	fs:string("name", "", "Name", {compgen=function(word, flags)
+		return {flags.host or "none"}
+	end})
+	`); err != nil {
+		t.Fatalf("runtime error: %v", err)
+	}
+	fs := L.GetGlobal("fs").(*lua.LUserData).Value.(*FlagSet)
+	host := fs.GoFlagSet().String("host", "localhost", "Host")
+
+	if err := fs.Validate(L, []string{"-host", "x"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if *host != "localhost" {
+		t.Errorf("expected: `%v`, got: `%v`", "localhost", *host)
+	}
+
+	c := fs.Clone()
+	if _, err := c.parse(L, []string{"-host", "y"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := c.GoFlagSet().Lookup("host").Value.String(); got != "y" || *host != "localhost" {
+		t.Errorf("expected: `y localhost`, got: `%v %v`", got, *host)
+	}
+
+	expected := []string{"example.org"}
+	if got := fs.Compgen(L, 4, []string{"cmd", "-host", "example.org", "-name", ""}); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected: `%v`, got: `%v`", expected, got)
+	}
+	if *host != "localhost" {
+		t.Errorf("expected: `%v`, got: `%v`", "localhost", *host)
+	}
+}
+
+func TestPortFlag(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:port("port", 80, "Port")
+	fs:returnErrors()
+
+	for _, p in ipairs({"0", "1", "65535", "65536", "http"}) do
+		fs:reset()
+		local flags, err = fs:parseArgs({"-port", p})
+		if err then
+			print(p, err.message)
+		else
+			print(p, flags.port, type(flags.port))
+		end
+	end
+
+	any = flag.new()
+	any:port("port", 0, "Port", {anyPort=true})
+	any:ports("ports", "Ports", {split=true})
+	flags = any:parseArgs({"-port", "0", "-ports", "1,65535", "-ports", "8080"})
+	print(flags.port, table.concat(flags.ports, " "))
+
+	print(pcall(function() fs:port("bad", 0, "Bad") end))
+	`
+
+	expected := strings.Join([]string{
+		"0	invalid value \"0\" for flag -port: expected port between 1 and 65535",
+		"1	1	number",
+		"65535	65535	number",
+		"65536	invalid value \"65536\" for flag -port: expected port between 1 and 65535",
+		"http	invalid value \"http\" for flag -port: expected port between 1 and 65535",
+		"0	1 65535 8080",
+		"false	<string>:23: bad argument #3 to port (expected port between 1 and 65535)",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestParseArgsGo(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	var port *int
+	var verbose *bool
+	res, err := ParseArgs(L, "cmd", []string{"-port", "8080", "-v"}, func(fs *FlagSet) {
+		port = fs.GoFlagSet().Int("port", 80, "Port")
+		verbose = fs.GoFlagSet().Bool("v", false, "Verbose")
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *port != 8080 || !*verbose {
+		t.Errorf("expected: `8080 true`, got: `%v %v`", *port, *verbose)
+	}
+	if got := res.RawGetString("port").String(); got != "8080" {
+		t.Errorf("expected: `%v`, got: `%v`", "8080", got)
+	}
+
+	var out bytes.Buffer
+	_, err = ParseArgs(L, "cmd", []string{"-missing"}, func(fs *FlagSet) {
+		fs.SetOutput(&out)
+	})
+	if _, ok := err.(*ParseError); !ok {
+		t.Errorf("expected *ParseError, got: `%v`", err)
+	}
+	if out.Len() > 0 {
+		t.Errorf("expected no output, got: `%v`", out.String())
+	}
+}
+
+func TestFlagTakesValue(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	L.PreloadModule("flag", Loader)
+
+	if err := L.DoString(`
+	local flag = require('flag')
+	fs = flag.new("cmd")
+	fs:bool("verbose", false, "Verbose", {alias="v"})
+	fs:bools("debug", "Debug")
+	fs:count("level", 0, "Level")
+	fs:string("name", "", "Name")
+	fs:int("n", 1, "Number")
+	fs:number("ratio", 0.5, "Ratio")
+	fs:strings("tags", "Tags")
+	`); err != nil {
+		t.Fatalf("runtime error: %v", err)
+	}
+	fs := L.GetGlobal("fs").(*lua.LUserData).Value.(*FlagSet)
+	fs.GoFlagSet().Bool("quiet", false, "Quiet")
+	fs.GoFlagSet().String("host", "", "Host")
+
+	expected := map[string]bool{
+		"verbose": false,
+		"v":       false,
+		"debug":   false,
+		"level":   false,
+		"quiet":   false,
+		"missing": false,
+		"name":    true,
+		"n":       true,
+		"ratio":   true,
+		"tags":    true,
+		"host":    true,
+	}
+	for name, want := range expected {
+		if got := fs.FlagTakesValue(name); got != want {
+			t.Errorf("%v: expected: `%v`, got: `%v`", name, want, got)
+		}
+	}
+}
+
+func TestParseStructured(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("name", "", "Name")
+	fs:bool("v", false, "Verbose")
+	fs:stringArg("src", 1, "Source")
+	fs:collectRest()
+
+	res = fs:parseStructured({[0] = "cmd", "-name", "foo", "a", "b", "c"})
+	print(res.flags.name, res.flags.v, res.args.src, table.concat(res.positionals, " "))
+	print(res.name, res.src, res.rest)
+
+	fs2 = flag.new()
+	fs2:int("n", 1, "Number")
+	res = fs2:parseStructured({[0] = "cmd", "-n", "2", "x", "y"})
+	print(res.flags.n, next(res.args), table.concat(res.positionals, " "))
+	`
+
+	expected := strings.Join([]string{
+		"foo\tfalse\ta\tb c",
+		"nil\tnil\tnil",
+		"2\tnil\tx y",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestRedefinedFlag(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:ints("times", "Times", {alias="t"})
+
+	print(pcall(function() fs:int("times", 1, "Times") end))
+	print(pcall(function() fs:strings("times", "Times") end))
+	print(pcall(function() fs:bool("verbose", false, "Verbose", {alias="t"}) end))
+	print(pcall(function() fs:string("t", "", "T") end))
+	print(pcall(function() fs:string("name", "", "Name", {alias="name"}) end))
+	print(pcall(function() fs:port("times", 80, "Port") end))
+	print(pcall(function() fs:json("filter", "Filter", {alias="t"}) end))
+	`
+
+	expected := strings.Join([]string{
+		"false\t<string>:6: flag \"times\" already defined",
+		"false\t<string>:7: flag \"times\" already defined",
+		"false\t<string>:8: flag \"t\" already defined",
+		"false\t<string>:9: flag \"t\" already defined",
+		"false\t<string>:10: flag \"name\" already defined",
+		"false\t<string>:11: flag \"times\" already defined",
+		"false\t<string>:12: flag \"t\" already defined",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestRedefinedArgument(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("name", "", "Name")
+	fs:stringArg("src", 1, "Source")
+
+	print(pcall(function() fs:intArg("src", 1, "Source") end))
+	print(pcall(function() fs:stringArg("name", 1, "Name") end))
+	print(pcall(function() fs:restArg("name", "Name") end))
+	print(pcall(function() fs:bool("src", false, "Source") end))
+	`
+
+	expected := strings.Join([]string{
+		"false\t<string>:7: argument \"src\" already defined",
+		"false\t<string>:8: argument \"name\" collides with flag \"name\"",
+		"false\t<string>:9: argument \"name\" collides with flag \"name\"",
+		"false\t<string>:10: flag \"src\" collides with argument \"src\"",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestIntBase(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:int("mask", 0, "Mask", {base=16})
+	fs:int64("mode", 0, "Mode", {base=8})
+	fs:uint("bits", 0, "Bits", {base=2})
+	fs:uint64("any", 0, "Any", {base=0, max=300})
+
+	flags = fs:parse({[0] = "cmd", "-mask", "ff", "-mode", "755", "-bits", "1010", "-any", "0x1f"})
+	print(flags.mask, flags.mode, flags.bits, flags.any)
+
+	fs:reset()
+	flags = fs:parse({[0] = "cmd", "-any", "0o17"})
+	print(flags.any)
+
+	fs:reset()
+	flags = fs:parse({[0] = "cmd", "-any", "0b11"})
+	print(flags.any)
+
+	fs:reset()
+	print(pcall(function() fs:parse({[0] = "cmd", "-mask", "fg"}) end))
+	fs:reset()
+	print(pcall(function() fs:parse({[0] = "cmd", "-any", "0xfff"}) end))
+	`
+
+	expected := strings.Join([]string{
+		"255\t493\t10\t31",
+		"15",
+		"3",
+		"false\t<string>:21: invalid value \"fg\" for flag -mask: strconv.ParseInt: parsing \"fg\": invalid syntax",
+		"false\t<string>:23: invalid value \"0xfff\" for flag -any: any: 4095 exceeds max 300",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:int("x", 0, "X")
+
+	flags = fs:parseArgs({"-x", "1", "a"})
+	print(flags.x, flags[1])
+
+	fs:reset()
+	flags = fs:parse({"-x", "1", "a"})
+	print(flags.x, flags[1], flags[2])
+	`
+
+	expected := strings.Join([]string{
+		"1\ta",
+		"0\t1\ta",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestInterspersed(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:int("a", 0, "A")
+	fs:int("b", 0, "B")
+	fs:bool("v", false, "Verbose")
+
+	args = {[0] = "cmd", "-a", "1", "pos", "-b", "2"}
+	flags = fs:parse(args)
+	print(flags.a, flags.b, table.concat(flags, " "))
+
+	fs:reset()
+	fs:interspersed()
+	flags = fs:parse(args)
+	print(flags.a, flags.b, table.concat(flags, " "))
+
+	fs:reset()
+	flags = fs:parse({[0] = "cmd", "x", "-v", "-5", "-b=3", "--", "-a", "4"})
+	print(flags.a, flags.b, flags.v, table.concat(flags, " "))
+
+	run = flag.new()
+	run:bool("v", false, "Verbose")
+	run:stringArg("cmd", 1, "Command")
+	run:restArg("args", "Arguments")
+	run:interspersed()
+	flags = run:parseArgs({"exec", "ls", "-v", "-a", "1"})
+	print(flags.v, flags.cmd, table.concat(flags.args, " "))
+
+	named = flag.new()
+	named:string("name", "", "Name")
+	named:int("verbose-level", 0, "Verbose level")
+	named:interspersed()
+	named:caseInsensitive()
+	for _, args in ipairs({{"pos", "-Name", "bob"}, {"-Name", "bob", "pos"}, {"pos", "-VERBOSE-LEVEL", "2"}}) do
+		named:reset()
+		flags = named:parseArgs(args)
+		print(flags.name, flags["verbose-level"], table.concat(flags, " "))
+	end
+
+	named:caseInsensitive(false)
+	named:abbreviations()
+	for _, args in ipairs({{"-verb", "2", "pos"}, {"pos", "-na", "bob", "-verb=3"}}) do
+		named:reset()
+		flags = named:parseArgs(args)
+		print(flags.name, flags["verbose-level"], table.concat(flags, " "))
+	end
+	`
+
+	expected := strings.Join([]string{
+		"1\t0\tpos -b 2",
+		"1\t2\tpos",
+		"0\t3\ttrue\tx -5 -a 4",
+		"false\texec\tls -v -a 1",
+		"bob\t0\tpos",
+		"bob\t0\tpos",
+		"\t2\tpos",
+		"\t2\tpos",
+		"bob\t3\tpos",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:ints("times", "Times", {alias="t", split=true, default={7}})
+	fs:strings("tags", "Tags")
+	fs:int("n", 0, "N")
+
+	flags = fs:parse({[0] = "cmd", "-t", "1", "-times", "2,3"})
+	print(#flags.times, fs:occurrences("times"), fs:occurrences("t"), fs:occurrences("tags"))
+
+	fs:reset()
+	flags = fs:parse({[0] = "cmd"})
+	print(#flags.times, fs:occurrences("times"))
+
+	print(pcall(function() fs:occurrences("n") end))
+	print(pcall(function() fs:occurrences("x") end))
+	`
+
+	expected := strings.Join([]string{
+		"3\t2\t2\t0",
+		"1\t0",
+		"false\t<string>:15: bad argument #2 to occurrences (flag -n is not a slice flag)",
+		"false\t<string>:16: bad argument #2 to occurrences (no such flag -x)",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestParseSimple(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	res = flag.parseSimple({[0] = "cmd", "-v", "-name", "foo", "a", "--size=10", "-5", "-q", "--", "-x"})
+	print(res.flags.v, res.flags.name, res.flags.size, res.flags.q, res.flags.x)
+	print(table.concat(res.positionals, " "))
+	`
+
+	expected := strings.Join([]string{
+		"true\tfoo\t10\ttrue\tnil",
+		"a -5 -x",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestDescriptionAndEpilog(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("greet")
+	fs:string("name", "", "Name")
+	fs:stringArg("title", 1, "Title")
+	fs:usageWidth(40)
+	fs:description("Greets somebody by name and title, politely.")
+	fs:epilog("Example:\n  greet -name foo sir")
+
+	print(fs:usage())
+	`
+
+	expected := strings.Join([]string{
+		"usage: greet [options] title ",
+		"",
+		"Greets somebody by name and title,",
+		"politely.",
+		"",
+		"  -name string",
+		"    \tName",
+		"  title string",
+		"    \tTitle",
+		"",
+		"Example:",
+		"  greet -name foo sir\n",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected stdout: `%v`\ngot: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestFlagFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gluaflag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	settings := filepath.Join(dir, "settings.json")
+	if err := ioutil.WriteFile(settings, []byte(`{"debug": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"token": "secret\n", "crlf": "secret\r\n", "lines": "a\n\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("config", "", "Config", {fromFile=true})
+	fs:string("raw", "", "Raw")
+
+	flags = fs:parse({[0] = "cmd", "-config", "@` + settings + `", "-raw", "@` + settings + `"})
+	print(flags.config, flags.raw)
+
+	fs:reset()
+	flags = fs:parse({[0] = "cmd", "-config", "@@home"})
+	print(flags.config)
+
+	fs:reset()
+	ok, err = pcall(function() fs:parse({[0] = "cmd", "-config", "@` + dir + `/missing.json"}) end)
+	print(err)
+
+	for _, name in ipairs({"token", "crlf", "lines"}) do
+		fs:reset()
+		flags = fs:parse({[0] = "cmd", "-config", "@` + dir + `/" .. name})
+		print(string.format("%q", flags.config))
+	end
+	`
+
+	expected := strings.Join([]string{
+		"{\"debug\": true}\t@" + settings,
+		"@home",
+		"<string>:15: invalid value \"@" + dir + "/missing.json\" for flag -config: reading value: open " + dir + "/missing.json: no such file or directory",
+		`"secret"`,
+		`"secret"`,
+		`"a\n"`,
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestBoolExplicitValue(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:bool("debug", false, "Debug", {explicitValue=true, alias="d"})
+	fs:bool("v", false, "Verbose")
+
+	for _, args in ipairs({
+		{"-debug"},
+		{"-debug=false"},
+		{"-debug", "pos"},
+		{"-d", "true", "pos"},
+		{"-debug", "false", "-v", "true"},
+	}) do
+		fs:reset()
+		flags = fs:parseArgs(args)
+		print(flags.debug, flags.v, table.concat(flags, " "))
+	end
+
+	fs:caseInsensitive()
+	fs:abbreviations()
+	for _, args in ipairs({{"-Debug", "false", "pos"}, {"-deb", "false"}}) do
+		fs:reset()
+		flags = fs:parseArgs(args)
+		print(flags.debug, flags.v, table.concat(flags, " "))
+	end
+	`
+
+	expected := strings.Join([]string{
+		"true\tfalse\t",
+		"false\tfalse\t",
+		"true\tfalse\tpos",
+		"true\tfalse\tpos",
+		"false\ttrue\ttrue",
+		"false\tfalse\tpos",
+		"false\tfalse\t",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestParseErrorUnwrap(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+
+	setup := func(fs *FlagSet) {
+		fs.GoFlagSet().Int("n", 0, "Number")
+		fs.GoFlagSet().Bool("v", false, "Verbose")
+	}
+	tests := []struct {
+		args  []string
+		kind  ErrorKind
+		flag  string
+		token string
+	}{
+		{[]string{"-help"}, KindHelp, "", ""},
+		{[]string{"-v", "-x"}, KindUnknownFlag, "x", "-x"},
+		{[]string{"--x=1"}, KindUnknownFlag, "x", "--x"},
+		{[]string{"-v", "-n"}, KindMissingValue, "n", "-n"},
+		{[]string{"-n", "one"}, KindInvalidValue, "n", "one"},
+		{[]string{"-v=maybe"}, KindInvalidValue, "v", "maybe"},
+	}
+	for _, test := range tests {
+		_, err := ParseArgs(L, "cmd", test.args, setup)
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Fatalf("%v: expected *ParseError, got: `%v`", test.args, err)
+		}
+		if perr.Kind != test.kind || perr.Flag != test.flag || perr.Token != test.token {
+			t.Errorf("%v: expected: `%v %v %v`, got: `%v %v %v`", test.args, test.kind, test.flag, test.token, perr.Kind, perr.Flag, perr.Token)
+		}
+		if test.kind == KindHelp && !errors.Is(err, flag.ErrHelp) {
+			t.Errorf("%v: expected errors.Is(err, flag.ErrHelp)", test.args)
+		}
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:setOutput(function() end)
+	fs:int("count", 0, "Count")
+	fs:stringArg("title", 1, "Title")
+	fs:intArg("sizes", "+", "Sizes")
+	fs:returnErrors()
+
+	for _, args in ipairs({
+		{"-count", "1", "book", "1", "x", "3"},
+		{"-count", "x", "book", "1"},
+		{"-missing", "book", "1"},
+	}) do
+		fs:reset()
+		local _, err = fs:parseArgs(args)
+		print(err.kind, err.token, err.position, err.message)
+	end
+	`
+
+	expected := strings.Join([]string{
+		"argument\tx\t5\targument sizes: invalid integer value: x",
+		"invalid_value\tx\t2\tinvalid value \"x\" for flag -count: parse error",
+		"unknown_flag\t-missing\t1\tflag provided but not defined: -missing",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestParseCollect(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:setOutput(function() end)
+	fs:int("count", 0, "Count", {required=true})
+	fs:string("name", "", "Name", {validate=function(v) return v ~= "bad" end})
+
+	flags, errs = fs:parseCollect({[0] = "cmd", "-name", "bad"})
+	print(flags, #errs)
+	for _, e in ipairs(errs) do
+		print(e.kind, e.flag, e.message)
+	end
+
+	fs:reset()
+	flags, errs = fs:parseCollect({[0] = "cmd", "-count", "x"})
+	print(flags, #errs, errs[1].kind, errs[1].flag)
+
+	fs:reset()
+	flags, errs = fs:parseCollect({[0] = "cmd", "-count", "1"})
+	print(flags.count, #errs)
+	`
+
+	expected := strings.Join([]string{
+		"nil\t2",
+		"missing_required\tcount\tflag -count is required",
+		"validation\tname\tinvalid value \"bad\" for flag -name: validation failed",
+		"nil\t1\tinvalid_value\tcount",
+		"1\t0",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestFlagPrefix(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("tool")
+	fs:string("name", "", "Name", {complete={"foo", "bar"}})
+	fs:bool("v", false, "Verbose")
+	fs:stringArg("file", "?", "File", function(word) return {word .. "ile"} end)
+	fs:flagPrefix("/")
+
+	flags = fs:parse({[0] = "tool", "/name", "value", "-v", "/tmp/file"})
+	print(flags.name, flags.v, flags.file)
+
+	print(table.concat(fs:compgen(1, {[0] = "tool", "/"}), " "))
+	print(table.concat(fs:compgen(2, {[0] = "tool", "/name"}), " "))
+	print(table.concat(fs:compgen(1, {[0] = "tool", "/tmp/f"}), " "))
+	print(table.concat(fs:compgen(1, {[0] = "tool", "/x"}), " "))
+	print(fs:flagUsage("v"))
+	`
+
+	expected := strings.Join([]string{
+		"value\ttrue\t/tmp/file",
+		"/name /v",
+		"foo bar",
+		"/tmp/file",
+		"/xile",
+		"  /v\tVerbose",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestFlagFromStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = old }()
+
+	w.WriteString("piped\ncontent")
+	w.Close()
+
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:string("body", "", "Body", {stdin=true})
+
+	flags = fs:parse({[0] = "cmd", "-body", "-"})
+	print(flags.body)
+
+	fs:reset()
+	flags = fs:parse({[0] = "cmd", "-body", "text"})
+	print(flags.body)
+	`
+
+	expected := strings.Join([]string{
+		"piped\ncontent",
+		"text",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestValidateSideEffects(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = old }()
+
+	w.WriteString("piped")
+	w.Close()
+
+	src := `
+	local flag = require('flag')
+	calls = {}
+	fs = flag.new()
+	fs:string("body", "", "Body", {stdin=true})
+	fs:string("config", "", "Config", {fromFile=true})
+	fs:string("name", "", "Name", {validate=function(v)
+		table.insert(calls, "validate " .. v)
+		return true
+	end})
+	fs:custom("color", "Color", {set=function(s)
+		table.insert(calls, "set " .. s)
+		return s
+	end})
+	fs:int("n", 0, "N")
+
+	print(fs:validate({[0] = "cmd", "-body", "-", "-config", "@/missing", "-name", "x", "-color", "red"}))
+	print(fs:validate({[0] = "cmd", "-n", "x"}))
+	print(#calls)
+
+	flags = fs:parse({[0] = "cmd", "-body", "-"})
+	print(flags.body)
+	`
+
+	expected := strings.Join([]string{
+		"true",
+		"false\tinvalid value \"x\" for flag -n: parse error",
+		"0",
+		"piped",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestUsageBody(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("greet")
+	fs:string("name", "", "Name")
+	fs:stringArg("title", 1, "Title")
+
+	print(fs:body())
+	print(fs:usage())
+	fs:description("Greets somebody.")
+	print(fs:body())
+	`
+
+	expected := strings.Join([]string{
+		"  -name string",
+		"    \tName",
+		"  title string",
+		"    \tTitle",
+		"",
+		"usage: greet [options] title ",
+		"  -name string",
+		"    \tName",
+		"  title string",
+		"    \tTitle",
+		"",
+		"Greets somebody.",
+		"",
+		"  -name string",
+		"    \tName",
+		"  title string",
+		"    \tTitle\n",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected stdout: `%v`\ngot: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestPrintUsage(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("greet")
+	fs:string("name", "", "Name")
+	fs:stringArg("title", 1, "Title")
+
+	local n = 0
+	fs:printUsage(function(line)
+		n = n + 1
+		print(n .. "|" .. line)
+	end)
+	print(pcall(function() fs:printUsage(function() error("stop") end) end))
+	`
+
+	expected := strings.Join([]string{
+		"1|usage: greet [options] title ",
+		"2|  -name string",
+		"3|    \tName",
+		"4|  title string",
+		"5|    \tTitle",
+		"false\t<string>:12: stop",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestOptionalValue(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new("cmd")
+	fs:string("log", "", "Log file", {optionalValue="default.log", alias="l"})
+	fs:string("name", "", "Name")
+	fs:stringArg("src", "?", "Source")
+
+	flags = fs:parseArgs({})
+	print("[" .. flags.log .. "]", flags.src)
+
+	fs:reset()
+	flags = fs:parseArgs({"-log", "file.txt"})
+	print(flags.log, flags.src)
+
+	fs:reset()
+	flags = fs:parseArgs({"-name", "-log", "-l=custom.txt"})
+	print(flags.log, flags.name)
+
+	fs:reset()
+	flags = fs:parseArgs({"-log=true"})
+	print(flags.log)
+
+	print(fs:flagUsage("log"))
+	`
+
+	expected := strings.Join([]string{
+		"[]\tnil",
+		"default.log\tfile.txt",
+		"custom.txt\t-log",
+		"true",
+		"  -log, -l[=string]",
+		"    \tLog file (\"default.log\" without value)",
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestParseReturnsUnknownArgument(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	L.PreloadModule("flag", Loader)
+
+	if err := L.DoString(`
+	local flag = require('flag')
+	fs = flag.new("cmd")
+	fs:stringArg("title", 1, "Title")
+	`); err != nil {
+		t.Fatalf("runtime error: %v", err)
+	}
+	ud := L.GetGlobal("fs").(*lua.LUserData)
+
+	_, err := Parse(L, ud, []string{"book", "surplus"})
+	perr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("expected *ParseError, got: `%v`", err)
+	}
+	if perr.Kind != KindUnknownArgument || perr.Error() != "unknown argument: [surplus]" {
+		t.Errorf("expected: `%v: %v`, got: `%v: %v`", KindUnknownArgument, "unknown argument: [surplus]", perr.Kind, perr.Error())
+	}
+
+	if err := L.DoString(`fs:reset(); flags = fs:parse({[0] = "cmd", "book"})`); err != nil {
+		t.Fatalf("runtime error: %v", err)
 	}
 }
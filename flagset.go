@@ -7,25 +7,90 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/yuin/gopher-lua"
 )
 
 var flagSetFuncs = map[string]lua.LGFunction{
-	"number":    number,
-	"numbers":   numbers,
-	"int":       integer,
-	"ints":      integers,
-	"string":    str,
-	"strings":   strs,
-	"bool":      boolean,
-	"stringArg": stringArgument,
-	"intArg":    intArgument,
-	"numberArg": numberArgument,
-	"parse":     parse,
-	"compgen":   compgen,
-	"usage":     usage,
+	"number":            number,
+	"numbers":           numbers,
+	"float32":           float32Number,
+	"float32s":          float32Numbers,
+	"int":               integer,
+	"int64":             integer64,
+	"uint":              uinteger,
+	"uint64":            uinteger64,
+	"port":              port,
+	"ports":             ports,
+	"ints":              integers,
+	"string":            str,
+	"strings":           strs,
+	"duration":          duration,
+	"durations":         durations,
+	"keyvalue":          keyvalue,
+	"bool":              boolean,
+	"bools":             booleans,
+	"count":             count,
+	"choice":            choice,
+	"custom":            custom,
+	"json":              jsonFlag,
+	"stringArg":         stringArgument,
+	"intArg":            intArgument,
+	"numberArg":         numberArgument,
+	"restArg":           restArgument,
+	"parse":             parse,
+	"parseStructured":   parseStructured,
+	"parseArgs":         parseArgs,
+	"parseCollect":      parseCollect,
+	"narg":              narg,
+	"nflag":             nflag,
+	"set":               isSet,
+	"setOutput":         setOutput,
+	"reset":             reset,
+	"clone":             clone,
+	"validate":          validateArgs,
+	"default":           defaultValue,
+	"occurrences":       occurrences,
+	"defaults":          defaults,
+	"caseInsensitive":   caseInsensitive,
+	"usageOnError":      usageOnError,
+	"command":           command,
+	"exclusive":         exclusive,
+	"requiredTogether":  requiredTogether,
+	"deprecated":        deprecated,
+	"ignoreUnknown":     ignoreUnknown,
+	"collectRest":       collectRest,
+	"longFlags":         longFlags,
+	"flagPrefix":        flagPrefix,
+	"color":             color,
+	"responseFiles":     responseFiles,
+	"filterCompletions": filterCompletions,
+	"cacheCompletions":  cacheCompletions,
+	"returnErrors":      returnErrors,
+	"collectErrors":     collectErrors,
+	"abbreviations":     abbreviations,
+	"interspersed":      interspersed,
+	"positionals":       positionals,
+	"completionScript":  completionScript,
+	"completionSpec":    completionSpec,
+	"compgen":           compgen,
+	"usage":             usage,
+	"printUsage":        printUsage,
+	"body":              body,
+	"description":       description,
+	"epilog":            epilog,
+	"flagUsage":         flagUsage,
+	"flagType":          flagType,
+	"setUsage":          setUsage,
+	"toJSON":            toJSON,
+	"orderedUsage":      orderedUsage,
+	"groupUsage":        groupUsage,
+	"sortFlags":         sortFlags,
+	"usageWidth":        usageWidth,
 }
 
 // FlagSet is the background userdata component
@@ -33,8 +98,43 @@ type FlagSet struct {
 	name      string
 	fs        *flag.FlagSet
 	flags     flgs
+	order     []string
 	arguments arguments
 	output    io.Writer
+	visited   map[string]bool
+	aliases   map[string]string
+
+	caseInsensitive   bool
+	ignoreUnknown     bool
+	orderedUsage      bool
+	groupUsage        bool
+	collectRest       bool
+	longFlags         bool
+	color             bool
+	responseFiles     bool
+	filterCompletions bool
+	returnErrors      bool
+	abbreviations     bool
+	collectErrors     bool
+	interspersed      bool
+	usageWidth        int
+	errorUsage        string
+	description       string
+	epilog            string
+	prefix            string
+	usageFunc         func(*FlagSet) string
+	dryRun            bool
+
+	commands     map[string]*FlagSet
+	commandNames []string
+
+	// compCache holds the results of completion functions, keyed on the flag
+	// or argument name, the words and the extra parameters, when caching is
+	// enabled
+	compCache map[string][]completion
+
+	exclusive [][]string
+	together  [][]string
 }
 
 // New returns a new flagset userdata
@@ -47,12 +147,16 @@ func New(L *lua.LState, name string) *lua.LUserData {
 		flags:     make(flgs),
 		arguments: make(arguments, 0),
 		output:    os.Stderr,
-	}
+		visited:   make(map[string]bool),
+		aliases:   make(map[string]string),
 
-	flags.fs.Usage = func() {
-		fmt.Fprint(flags.output, flags.Usage())
+		errorUsage: "full",
+		commands:   make(map[string]*FlagSet),
 	}
 
+	// usage is written by Parse depending on the error usage mode
+	flags.fs.Usage = func() {}
+
 	ud := L.NewUserData()
 	ud.Value = flags
 	L.SetMetatable(ud, L.GetTypeMetatable(luaFlagSetTypeName))
@@ -60,35 +164,130 @@ func New(L *lua.LState, name string) *lua.LUserData {
 }
 
 func new(L *lua.LState) int {
-	var d lua.LValue = lua.LString("")
-	larg := L.GetGlobal("arg")
-	if targ, ok := larg.(*lua.LTable); ok {
-		d = targ.RawGetInt(0)
+	// the name defaults to the program name, arg[0]
+	var d string
+	if targ, ok := L.GetGlobal("arg").(*lua.LTable); ok {
+		d = toArgs(targ)[0]
 	}
-	name := L.OptString(1, d.String())
+	name := L.OptString(1, d)
 
 	L.Push(New(L, name))
 
 	return 1
 }
 
+// parseSimple splits an arg table into {flags={...}, positionals={...}}
+// without defined flags. A flag takes the value after = or, if the next
+// argument does not start with "-", the next argument, otherwise it is true.
+// As there are no definitions `-v file` sets v to "file", values are strings
+// and the last of repeated flags wins. Negative numbers are positionals and
+// "--" ends the flags.
+func parseSimple(L *lua.LState) int {
+	args := toArgs(L.CheckTable(1))[1:]
+
+	flags := L.NewTable()
+	positionals := L.NewTable()
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			for _, p := range args[i+1 : len(args)] {
+				positionals.Append(lua.LString(p))
+			}
+			break
+		}
+		if _, err := strconv.ParseFloat(arg, 64); !isFlag(arg) || arg == "-" || err == nil {
+			positionals.Append(lua.LString(arg))
+			continue
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if j := strings.Index(name, "="); j >= 0 {
+			flags.RawSetString(name[:j], lua.LString(name[j+1:len(name)]))
+			continue
+		}
+		if i+1 < len(args) && !isFlag(args[i+1]) {
+			i++
+			flags.RawSetString(name, lua.LString(args[i]))
+			continue
+		}
+		flags.RawSetString(name, lua.LTrue)
+	}
+
+	t := L.NewTable()
+	t.RawSetString("flags", flags)
+	t.RawSetString("positionals", positionals)
+	L.Push(t)
+	return 1
+}
+
 // Usage returns the usage message for the flag set
 func (fs *FlagSet) Usage() string {
+	if fs.usageFunc != nil {
+		return fs.usageFunc(fs)
+	}
+
 	buff := &bytes.Buffer{}
 
 	buff.WriteString(fmt.Sprintf("usage: %v\n", fs.ShortUsage()))
+	if fs.description != "" {
+		buff.WriteString("\n")
+	}
+	buff.WriteString(fs.Body())
+
+	return buff.String()
+}
 
-	fs.fs.SetOutput(buff)
-	defer fs.fs.SetOutput(os.Stderr)
-	fs.fs.PrintDefaults()
+// Body returns the usage message without the usage line, for embedding in a
+// larger help text
+func (fs *FlagSet) Body() string {
+	buff := &bytes.Buffer{}
+	if fs.description != "" {
+		fmt.Fprintf(buff, "%v\n\n", wrapText(fs.description, fs.width()))
+	}
+
+	fs.printDefaults(buff)
 
 	for _, arg := range fs.arguments {
-		buff.WriteString(arg.generateUsage())
+		buff.WriteString(arg.generateUsage(fs.width()))
+	}
+
+	if fs.epilog != "" {
+		fmt.Fprintf(buff, "\n%v\n", fs.epilog)
 	}
 
 	return buff.String()
 }
 
+// SetUsageFunc replaces the built-in usage message with the one returned by
+// fn, nil restores the built-in message
+func (fs *FlagSet) SetUsageFunc(fn func(*FlagSet) string) {
+	fs.usageFunc = fn
+}
+
+// SetDescription sets the text shown after the usage line of the usage
+// message
+func (fs *FlagSet) SetDescription(text string) {
+	fs.description = text
+}
+
+func description(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetDescription(L.CheckString(2))
+	return 0
+}
+
+// SetEpilog sets the text shown at the end of the usage message, e.g.
+// examples. Unlike the description it is not wrapped, to keep its layout.
+func (fs *FlagSet) SetEpilog(text string) {
+	fs.epilog = text
+}
+
+func epilog(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetEpilog(L.CheckString(2))
+	return 0
+}
+
 // ShortUsage returns the usage string for a flagset
 func (fs *FlagSet) ShortUsage() string {
 	buff := &bytes.Buffer{}
@@ -107,9 +306,7 @@ func (fs *FlagSet) ShortUsage() string {
 // FlagDefaults returns the flagsets help string for the flags
 func (fs *FlagSet) FlagDefaults() string {
 	buff := &bytes.Buffer{}
-	fs.fs.SetOutput(buff)
-	defer fs.fs.SetOutput(os.Stderr)
-	fs.fs.PrintDefaults()
+	fs.printDefaults(buff)
 
 	return buff.String()
 }
@@ -118,136 +315,362 @@ func (fs *FlagSet) FlagDefaults() string {
 func (fs *FlagSet) ArgDefaults() string {
 	buff := &bytes.Buffer{}
 	for _, arg := range fs.arguments {
-		buff.WriteString(arg.generateUsage())
+		buff.WriteString(arg.generateUsage(fs.width()))
 	}
 
 	return buff.String()
 }
 
+// printDefaults writes the help string for the flags in the same format as
+// flag.PrintDefaults, but with aliases grouped with the primary flag
+func (fs *FlagSet) printDefaults(w io.Writer) {
+	if fs.groupUsage {
+		fs.printGroupedDefaults(w)
+		return
+	}
+
+	for _, fl := range fs.usageFlags() {
+		fmt.Fprint(w, fs.flagDefaults(fl), "\n")
+	}
+}
+
+// printGroupedDefaults writes the help string for the flags grouped by the
+// prefix of their name before the first "-", under a heading per group.
+// Flags without prefix are written first, without heading.
+func (fs *FlagSet) printGroupedDefaults(w io.Writer) {
+	var groups []string
+	grouped := make(map[string][]*flag.Flag)
+	for _, fl := range fs.usageFlags() {
+		var group string
+		if i := strings.Index(fl.Name, "-"); i > 0 {
+			group = fl.Name[:i]
+		}
+		if _, ok := grouped[group]; !ok && group != "" {
+			groups = append(groups, group)
+		}
+		grouped[group] = append(grouped[group], fl)
+	}
+
+	for _, fl := range grouped[""] {
+		fmt.Fprint(w, fs.flagDefaults(fl), "\n")
+	}
+	for _, group := range groups {
+		fmt.Fprintf(w, "\n%v\n", fs.paint(ansiBold, group+":"))
+		for _, fl := range grouped[group] {
+			fmt.Fprint(w, fs.flagDefaults(fl), "\n")
+		}
+	}
+}
+
+// SetGroupUsage makes the usage group flags by the prefix of their name
+// before the first "-", e.g. -db-host and -db-port are listed under "db"
+func (fs *FlagSet) SetGroupUsage(b bool) {
+	fs.groupUsage = b
+}
+
+func groupUsage(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetGroupUsage(L.OptBool(2, true))
+	return 0
+}
+
+// flagDefaults returns the help string of a single flag as written by
+// printDefaults
+func (fs *FlagSet) flagDefaults(fl *flag.Flag) string {
+	b := &bytes.Buffer{}
+	prefix := "-"
+	if fs.prefix != "" {
+		prefix = fs.flagPrefix()
+	}
+	fmt.Fprintf(b, "  %v", fs.paint(ansiBold, prefix+fl.Name))
+	f, ok := fs.flags[fl.Name]
+	aliased := ok && f.alias != ""
+	if aliased {
+		fmt.Fprintf(b, ", %v", fs.paint(ansiBold, prefix+f.alias))
+	}
+	name, usage := flag.UnquoteUsage(fl)
+	if ok && f.optionalValue != nil {
+		// the value reports itself as boolean, which has no value name
+		name, _ = flag.UnquoteUsage(&flag.Flag{Usage: fl.Usage, Value: unwrapValue(fl.Value)})
+		b.WriteString(fs.paint(ansiDim, "[="+name+"]"))
+		usage += fmt.Sprintf(" (%q without value)", *f.optionalValue)
+	} else if len(name) > 0 {
+		b.WriteString(" ")
+		b.WriteString(fs.paint(ansiDim, name))
+	}
+	// boolean flags of one ASCII letter fit on the same line
+	if len(fl.Name) == 1 && !aliased && len(name) == 0 {
+		b.WriteString("\t")
+	} else {
+		b.WriteString("\n    \t")
+	}
+	if !isZeroValue(fl) {
+		if g, ok := unwrapValue(fl.Value).(flag.Getter); ok && isString(g.Get()) {
+			usage += fmt.Sprintf(" (default %q)", fl.DefValue)
+		} else {
+			usage += fmt.Sprintf(" (default %v)", fl.DefValue)
+		}
+	}
+	usage = wrapText(usage, fs.width()-usageIndent)
+	b.WriteString(strings.Replace(usage, "\n", "\n    \t", -1))
+	return b.String()
+}
+
+// FlagUsage returns the help string of the flag with the given name or alias
+func (fs *FlagSet) FlagUsage(name string) (string, error) {
+	fl := fs.fs.Lookup(fs.canonicalName(name))
+	if fl == nil {
+		return "", fmt.Errorf("no such flag -%v", name)
+	}
+	return fs.flagDefaults(fl), nil
+}
+
+// FlagType returns the type of the flag with the given name or alias, as
+// the name of the function it was registered with, e.g. "ints"
+func (fs *FlagSet) FlagType(name string) (string, error) {
+	f, ok := fs.flags[fs.canonicalName(name)]
+	if !ok {
+		return "", fmt.Errorf("no such flag -%v", name)
+	}
+	return f.typeName(), nil
+}
+
+func flagType(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	name := L.CheckString(2)
+
+	typ, err := gf.FlagType(name)
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+
+	L.Push(lua.LString(typ))
+	return 1
+}
+
+func flagUsage(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	name := L.CheckString(2)
+
+	usage, err := gf.FlagUsage(name)
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+
+	L.Push(lua.LString(usage))
+	return 1
+}
+
+// usageFlags returns the flags to include in the usage, without aliases,
+// sorted by name or in registration order
+func (fs *FlagSet) usageFlags() []*flag.Flag {
+	var flags []*flag.Flag
+	if fs.orderedUsage {
+		for _, name := range fs.order {
+			flags = append(flags, fs.fs.Lookup(name))
+		}
+		return flags
+	}
+
+	fs.fs.VisitAll(func(fl *flag.Flag) {
+		if _, ok := fs.aliases[fl.Name]; !ok {
+			flags = append(flags, fl)
+		}
+	})
+	return flags
+}
+
+// FlagInfo describes a defined flag
+type FlagInfo struct {
+	Name     string
+	Alias    string
+	Type     string
+	Usage    string
+	Default  string
+	Required bool
+	Slice    bool
+}
+
+// ArgInfo describes a defined positional argument
+type ArgInfo struct {
+	Name    string
+	Type    string
+	Usage   string
+	Default string
+	Slice   bool
+}
+
+// Flags returns the defined flags in registration order
+func (fs *FlagSet) Flags() []FlagInfo {
+	flags := make([]FlagInfo, 0, len(fs.order))
+	for _, name := range fs.order {
+		flags = append(flags, fs.flagInfo(fs.flags[name]))
+	}
+	return flags
+}
+
+// flagInfo returns the description of a defined flag
+func (fs *FlagSet) flagInfo(f *flg) FlagInfo {
+	return FlagInfo{
+		Name:     f.name,
+		Alias:    f.alias,
+		Type:     f.typeName(),
+		Usage:    f.usage,
+		Default:  fs.fs.Lookup(f.name).DefValue,
+		Required: f.required,
+		Slice:    f.isSlice(),
+	}
+}
+
+// positionals returns the defined positional arguments of a parse result in
+// order, as a list of {name=, value=} tables
+func positionals(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	flags := L.CheckTable(2)
+
+	t := L.NewTable()
+	for _, a := range gf.arguments {
+		p := L.NewTable()
+		p.RawSetString("name", lua.LString(a.name))
+		p.RawSetString("value", flags.RawGetString(a.name))
+		t.Append(p)
+	}
+
+	L.Push(t)
+	return 1
+}
+
+// Arguments returns the defined positional arguments in registration order
+func (fs *FlagSet) Arguments() []ArgInfo {
+	args := make([]ArgInfo, 0, len(fs.arguments))
+	for _, a := range fs.arguments {
+		args = append(args, ArgInfo{
+			Name:    a.name,
+			Type:    a.typ,
+			Usage:   a.usage,
+			Default: a.defValue(),
+			Slice:   a.slice,
+		})
+	}
+	return args
+}
+
 func (fs *FlagSet) printFlags() string {
 	var s []string
 	fs.fs.VisitAll(func(fl *flag.Flag) {
-		s = append(s, "-"+fl.Name)
+		if _, ok := fs.aliases[fl.Name]; ok {
+			return
+		}
+		name := fs.flagPrefix() + fl.Name
+		if f, ok := fs.flags[fl.Name]; ok && f.alias != "" {
+			name = fmt.Sprintf("%v, %v%v", name, fs.flagPrefix(), f.alias)
+		}
+		s = append(s, name)
 	})
 	return strings.Join(s, "\n")
 }
 
-func (fs *FlagSet) getFlags() []string {
-	var s []string
+func (fs *FlagSet) getFlags() []completion {
+	var s []completion
 	fs.fs.VisitAll(func(fl *flag.Flag) {
-		s = append(s, "-"+fl.Name)
+		s = append(s, completion{value: fs.flagPrefix() + fl.Name, description: fl.Usage})
 	})
 	return s
 }
 
-// Compgen returns a string with possible options for the flag
+// Compgen returns the possible completions of the current word, formatted
+// for bash
 func (fs *FlagSet) Compgen(L *lua.LState, compCWords int, compWords []string) []string {
-	if compCWords == 1 && len(compWords) == 1 {
-		return fs.getArguments(compCWords, compWords, L)
+	comps, _ := fs.CompgenFormat(L, compCWords, compWords, "bash")
+	return comps
+}
+
+// CompgenFormat returns the possible completions of the current word in the
+// given format, which is one of "bash", "zsh" or "fish"
+func (fs *FlagSet) CompgenFormat(L *lua.LState, compCWords int, compWords []string, format string) ([]string, error) {
+	return formatCompletions(fs.complete(L, compCWords, compWords), format)
+}
+
+// complete returns the completions of the word at index compCWords. Once a
+// subcommand is given, the words from its name on are completed by the
+// subcommand, with the index rebased so the name is its program name.
+func (fs *FlagSet) complete(L *lua.LState, compCWords int, compWords []string) []completion {
+	if fs.prefix != "" && len(compWords) > 0 {
+		compWords = append([]string{compWords[0]}, fs.normalizePrefix(compWords[1:len(compWords)])...)
 	}
 
-	if compCWords <= len(compWords) {
-		prev := compWords[compCWords-1]
-		if string(prev[0]) == "-" {
-			fl := fs.fs.Lookup(prev[1:len(prev)])
-			v, ok := fs.flags[fl.Name]
+	if len(fs.commands) > 0 {
+		i := fs.commandIndex(compWords)
+		switch {
+		case compCWords == i:
+			return toCompletions(fs.commandNames)
+		case compCWords > i && i < len(compWords):
+			cmd, ok := fs.commands[compWords[i]]
 			if !ok {
-				return []string{}
+				return []completion{}
 			}
-			switch value := v.value.(type) {
-			case *bool:
-				if string(compWords[len(compWords)-1][0]) == "-" {
-					return fs.getFlags()
-				}
-				return []string{}
-			case *string, *float64, *int:
-				word := compWords[len(compWords)-1]
-				if compCWords == len(compWords) {
-					word = ""
-				}
-
-				table := L.NewTable()
-				fs.fs.Visit(func(f *flag.Flag) {
-					table.RawSetString(f.Name, lua.LString(f.Value.String()))
-				})
-
-				raw := L.NewTable()
-				for i, word := range compWords {
-					if i == 0 {
-						raw.RawSet(lua.LNumber(0), lua.LString(word))
-						continue
-					}
-					raw.Append(lua.LString(word))
-				}
+			return cmd.complete(L, compCWords-i, compWords[i:len(compWords)])
+		}
+	}
 
-				stack := L.GetTop()
-				if err := L.CallByParam(lua.P{
-					Fn:      v.compFn,
-					NRet:    -1,
-					Protect: true,
-				}, lua.LString(word), table, raw); err != nil {
-					fmt.Fprintf(os.Stderr, "%v\n", err)
-					os.Exit(1)
-				}
-				stack = L.GetTop() - stack
-
-				if stack == 1 {
-					res := L.Get(-1)
-					L.Pop(1)
-					switch r := res.(type) {
-					case *lua.LTable:
-						return toStringSlice(r)
-					case lua.LString:
-						s := string(r)
-						if strings.Index(s, "\n") > 0 {
-							return strings.Split(s, "\n")
-						}
-						return []string{s}
-					case *lua.LFunction:
-						return forEachStrings(L, r)
-					default:
-						L.RaiseError("unknown type: %T", r)
-					}
-				}
+	if compCWords == 1 && len(compWords) == 1 {
+		return fs.getArguments(compCWords, compWords, L)
+	}
 
-				res := []string{}
-				for i := 1; i <= stack; i++ {
-					res = append(res, L.Get(-i).String())
-				}
-				L.Pop(stack)
-				return res
+	// the value is joined with the flag, e.g. -name=fo
+	if compCWords < len(compWords) {
+		word := compWords[compCWords]
+		if i := strings.Index(word, "="); isFlag(word) && i > 0 {
+			v, ok := fs.flags[fs.canonicalName(strings.TrimLeft(word[:i], "-"))]
+			if !ok || v.compFn == nil || (!v.takesValue() && v.optionalValue == nil) {
+				return []completion{}
+			}
+			comps := fs.parseWords(compWords[1:compCWords]).callCompFn(L, v.name, v.compFn, word[i+1:len(word)], compWords)
+			res := make([]completion, 0, len(comps))
+			for _, comp := range comps {
+				comp.prefix = word[:i+1]
+				res = append(res, comp)
+			}
+			return res
+		}
+	}
 
-			default:
-				L.RaiseError("not implemented type: %T", value)
-				return []string{}
+	if compCWords <= len(compWords) {
+		if fl := fs.pendingFlag(compWords[:compCWords]); fl != nil {
+			v, ok := fs.flags[fs.canonicalName(fl.Name)]
+			if !ok {
+				return []completion{}
 			}
-		} else if string(compWords[len(compWords)-1][0]) == "-" {
+			word := compWords[len(compWords)-1]
+			if compCWords == len(compWords) {
+				word = ""
+			}
+
+			return fs.parseWords(compWords[1:compCWords-1]).callCompFn(L, v.name, v.compFn, word, compWords)
+		} else if compCWords < len(compWords) && fs.isFlagWord(compWords[compCWords]) {
 			// current argument starts with "-"
 			return fs.getFlags()
 		} else { // argument
 			return fs.getArguments(compCWords, compWords, L)
 		}
 	}
-	return []string{}
+	return []completion{}
 }
 
-func (fs *FlagSet) getArguments(compCWords int, compWords []string, L *lua.LState) []string {
-	err := fs.fs.Parse(compWords[1:len(compWords)])
-	if err != nil {
-		return []string{}
-	}
-	nargs := fs.fs.NArg()
-	if nargs == len(fs.arguments) {
-		nargs--
-	}
-	word := compWords[len(compWords)-1]
-	if compCWords == len(compWords) {
-		word = ""
+// callCompFn calls a completion function with the word to complete, the
+// flags set so far, typed as returned by parse, the raw command line words
+// and any extra parameters. The function may return strings or
+// {value, description} pairs. The results are cached on name, command line
+// words and extra parameters when completion caching is enabled.
+func (fs *FlagSet) callCompFn(L *lua.LState, name string, fn *lua.LFunction, word string, compWords []string, extra ...lua.LValue) []completion {
+	key := completionKey(name, word, compWords, extra)
+	if comps, ok := fs.compCache[key]; ok {
+		return comps
 	}
 
 	table := L.NewTable()
 	fs.fs.Visit(func(f *flag.Flag) {
-		table.RawSetString(f.Name, lua.LString(f.Value.String()))
+		table.RawSetString(f.Name, fs.flagLValue(L, fs.fs.Lookup(fs.canonicalName(f.Name))))
 	})
 
 	raw := L.NewTable()
@@ -259,209 +682,2270 @@ func (fs *FlagSet) getArguments(compCWords int, compWords []string, L *lua.LStat
 		raw.Append(lua.LString(word))
 	}
 
-	if nargs >= len(fs.arguments) || nargs < 0 {
-		return []string{}
-	}
-
-	// stack is needed to know how the stack grows
 	stack := L.GetTop()
 	if err := L.CallByParam(lua.P{
-		Fn:      fs.arguments[nargs].compFn,
+		Fn:      fn,
 		NRet:    -1,
 		Protect: true,
-	}, lua.LString(word), table, raw); err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+	}, append([]lua.LValue{lua.LString(word), table, raw}, extra...)...); err != nil {
+		reraise(L, err)
 	}
 	stack = L.GetTop() - stack
 
-	if stack == 1 {
+	comps := fs.compFnResults(L, stack)
+	if fs.filterCompletions {
+		comps = matchCompletions(comps, word)
+	}
+	if fs.compCache != nil {
+		fs.compCache[key] = comps
+	}
+	return comps
+}
+
+// completionKey returns the key of the cached results of a completion
+// function, which depend on everything the function is called with
+func completionKey(name, word string, compWords []string, extra []lua.LValue) string {
+	parts := append([]string{name, word}, compWords...)
+	for _, v := range extra {
+		parts = append(parts, v.String())
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// compFnResults pops the n values returned by a completion function and
+// converts them to completions
+func (fs *FlagSet) compFnResults(L *lua.LState, n int) []completion {
+	if n == 1 {
 		res := L.Get(-1)
 		L.Pop(1)
 		switch r := res.(type) {
 		case *lua.LTable:
-			return toStringSlice(r)
-		case *lua.LString:
-			s := string(*r)
+			return tableCompletions(r)
+		case lua.LString:
+			s := string(r)
+			if s == "" {
+				return []completion{}
+			}
+			if fs.filterCompletions {
+				return toCompletions(strings.Fields(s))
+			}
 			if strings.Index(s, "\n") > 0 {
-				return strings.Split(s, "\n")
+				return toCompletions(strings.Split(s, "\n"))
 			}
-			return []string{s}
+			return []completion{{value: s}}
 		case *lua.LFunction:
-			return forEachStrings(L, r)
+			return toCompletions(forEachStrings(L, r))
 		default:
 			L.RaiseError("unknown type: %T", r)
 		}
 	}
 
-	res := []string{}
-	for i := 1; i <= stack; i++ {
-		res = append(res, L.Get(-i).String())
+	res := []completion{}
+	for i := 1; i <= n; i++ {
+		res = append(res, completion{value: L.Get(-i).String()})
 	}
-	L.Pop(stack)
+	L.Pop(n)
 	return res
+}
 
+// SetFilterCompletions makes completion drop the candidates returned by
+// completion functions that do not start with the word being completed.
+// Strings returned are split into candidates on white space.
+func (fs *FlagSet) SetFilterCompletions(b bool) {
+	fs.filterCompletions = b
 }
 
-func usage(L *lua.LState) int {
+func filterCompletions(L *lua.LState) int {
 	gf := checkFlagSet(L, 1)
-	L.Push(lua.LString(gf.Usage()))
-	return 1
+	gf.SetFilterCompletions(L.OptBool(2, true))
+	return 0
+}
+
+// SetCacheCompletions makes completion call each completion function at most
+// once per flag or argument and command line, for completion functions that
+// are expensive, e.g. run external commands. The results are reused by later
+// compgen calls with the same words until caching is disabled.
+func (fs *FlagSet) SetCacheCompletions(b bool) {
+	fs.compCache = nil
+	if b {
+		fs.compCache = make(map[string][]completion)
+	}
+}
+
+func cacheCompletions(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetCacheCompletions(L.OptBool(2, true))
+	return 0
+}
+
+// parseWords parses the words preceding the one being completed, on a best
+// effort basis, so completion functions can see the flags set so far. The
+// words are parsed by a clone, sharing the completion cache, to leave the
+// values of the flag set untouched.
+func (fs *FlagSet) parseWords(words []string) *FlagSet {
+	c := fs.Clone()
+	c.compCache = fs.compCache
+	c.fs.SetOutput(ioutil.Discard)
+	c.fs.Parse(words)
+	return c
+}
+
+// pendingFlag returns the flag whose value is the next word after words, or
+// nil if the last word is not a flag waiting for its value, e.g. because it
+// is a boolean flag, has its value joined with "=" or is itself a value
+func (fs *FlagSet) pendingFlag(words []string) *flag.Flag {
+	for i := 1; i < len(words); i++ {
+		word := words[i]
+		if word == "--" {
+			return nil
+		}
+		if !isFlag(word) || word == "-" || strings.Contains(word, "=") {
+			continue
+		}
+
+		name := strings.TrimLeft(word, "-")
+		if !fs.FlagTakesValue(name) {
+			continue
+		}
+		if i == len(words)-1 {
+			return fs.fs.Lookup(name)
+		}
+		// skip the value
+		i++
+	}
+	return nil
+}
+
+// commandIndex returns the index of the subcommand in the command line words,
+// which is the first word that is neither a flag nor a flag value
+func (fs *FlagSet) commandIndex(compWords []string) int {
+	for i := 1; i < len(compWords); i++ {
+		word := compWords[i]
+		if !isFlag(word) || word == "-" {
+			return i
+		}
+
+		name := strings.TrimLeft(word, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		if fs.FlagTakesValue(name) {
+			i++
+		}
+	}
+	return len(compWords)
+}
+
+// getArguments completes a positional argument. The completion function of
+// the argument is called with the 1-based position of the word among the
+// positional words, the name and the type of the argument as fourth, fifth
+// and sixth parameter, words beyond the defined arguments are completed by
+// the last argument if it takes several values.
+func (fs *FlagSet) getArguments(compCWords int, compWords []string, L *lua.LState) []completion {
+	err := fs.fs.Parse(compWords[1:len(compWords)])
+	if err != nil {
+		return []completion{}
+	}
+	word := compWords[len(compWords)-1]
+	position := fs.fs.NArg()
+	if compCWords == len(compWords) {
+		word = ""
+		position++
+	}
+
+	i := position - 1
+	if last := len(fs.arguments) - 1; i > last && last >= 0 && fs.arguments[last].slice {
+		i = last
+	}
+	if i >= len(fs.arguments) || i < 0 {
+		return []completion{}
+	}
+
+	arg := fs.arguments[i]
+	return fs.callCompFn(L, arg.name, arg.compFn, word, compWords, lua.LNumber(position), lua.LString(arg.name), lua.LString(arg.typ))
+}
+
+// addFlag stores the flag definition in registration order and applies its
+// validations and alias
+func (fs *FlagSet) addFlag(f *flg) {
+	if _, ok := fs.flags[f.name]; !ok {
+		fs.order = append(fs.order, f.name)
+	}
+	fs.flags[f.name] = f
+	f.def = f.copyValue()
+
+	fs.addBounds(f)
+	fs.addPattern(f)
+	fs.addSplit(f)
+	fs.addUnits(f)
+	fs.addBase(f)
+	fs.addFromFile(f)
+	fs.addStdin(f)
+	fs.addOptional(f)
+	fs.addCounter(f)
+	fs.addAlias(f)
+}
+
+// register defines the flag in the Go flag set and adds it with the options
+// common to all flag types, raising an error if the name or alias is taken
+func (fs *FlagSet) register(L *lua.LState, f *flg, opts *flagOptions) {
+	if err := fs.checkUndefined(f.name, opts.alias); err != nil {
+		L.RaiseError("%v", err)
+	}
+	f.required = opts.required
+	f.alias = opts.alias
+	f.deprecated = opts.deprecated
+	f.validate = opts.validate
+	f.compFn = opts.compFn
+	f.dynamic = opts.dynamic
+
+	fs.define(f)
+	fs.addFlag(f)
+}
+
+// checkUndefined returns an error if the name or alias of a new flag is
+// already used by another flag
+func (fs *FlagSet) checkUndefined(name, alias string) error {
+	for _, n := range []string{name, alias} {
+		if n != "" && fs.fs.Lookup(n) != nil {
+			return fmt.Errorf("flag %q already defined", n)
+		}
+	}
+	if name == alias {
+		return fmt.Errorf("flag %q already defined", alias)
+	}
+	for _, a := range fs.arguments {
+		if a.name == name || a.name == alias {
+			return fmt.Errorf("flag %q collides with argument %q", a.name, a.name)
+		}
+	}
+	for _, n := range []string{name, alias} {
+		if err := fs.checkCommandKey("flag", n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCommandKey returns an error if a flag or argument with the name would
+// share the parse result key of the matched command or its result
+func (fs *FlagSet) checkCommandKey(kind, name string) error {
+	if len(fs.commands) == 0 || name == "" {
+		return nil
+	}
+	if name == "command" {
+		return fmt.Errorf("%v %q collides with the matched command", kind, name)
+	}
+	if _, ok := fs.commands[name]; ok {
+		return fmt.Errorf("%v %q collides with command %q", kind, name, name)
+	}
+	return nil
+}
+
+// checkArgumentName returns an error if the name of a new positional argument
+// is used by another argument or a flag, they share the parse result
+func (fs *FlagSet) checkArgumentName(name string) error {
+	for _, a := range fs.arguments {
+		if a.name == name {
+			return fmt.Errorf("argument %q already defined", name)
+		}
+	}
+	if fs.fs.Lookup(name) != nil {
+		return fmt.Errorf("argument %q collides with flag %q", name, name)
+	}
+	return fs.checkCommandKey("argument", name)
+}
+
+// addAlias registers the alias of the flag, if any, against the same value
+func (fs *FlagSet) addAlias(f *flg) {
+	if f.alias == "" {
+		return
+	}
+
+	fs.fs.Var(fs.fs.Lookup(f.name).Value, f.alias, f.usage)
+	fs.aliases[f.alias] = f.name
+}
+
+// addBounds wraps the value of the flag to validate its min and max, if any
+func (fs *FlagSet) addBounds(f *flg) {
+	if f.min == nil && f.max == nil {
+		return
+	}
+
+	fl := fs.fs.Lookup(f.name)
+	fl.Value = &boundedValue{Value: fl.Value, name: f.name, min: f.min, max: f.max}
+}
+
+// addPattern wraps the value of the flag to validate it against the pattern,
+// if any
+func (fs *FlagSet) addPattern(f *flg) {
+	if f.pattern == nil {
+		return
+	}
+
+	fl := fs.fs.Lookup(f.name)
+	fl.Value = &patternValue{Value: fl.Value, name: f.name, pattern: f.pattern}
+}
+
+// addSplit wraps the value of a slice flag to split its values on commas
+func (fs *FlagSet) addSplit(f *flg) {
+	if !f.split || !f.isSlice() {
+		return
+	}
+
+	fl := fs.fs.Lookup(f.name)
+	fl.Value = &splitValue{Value: fl.Value}
+}
+
+// setSliceDefault sets the default list of a slice flag, the first value
+// given on the command line replaces it, unless appendDefaults is set, then
+// the values are appended to the defaults
+func (fs *FlagSet) setSliceDefault(name string, defaults []string, appendDefaults bool) error {
+	f, ok := fs.flags[name]
+	if !ok || len(defaults) == 0 || !f.isSlice() {
+		return nil
+	}
+
+	fl := fs.fs.Lookup(name)
+	// a default set before is replaced
+	if sd, ok := fl.Value.(*sliceDefault); ok {
+		fl.Value = sd.Value
+	}
+	unwrapValue(fl.Value).(resetter).reset("")
+	for _, d := range defaults {
+		if err := fl.Value.Set(d); err != nil {
+			return fmt.Errorf("invalid default value %q for flag -%v: %v", d, name, err)
+		}
+	}
+	fl.DefValue = fl.Value.String()
+	fl.Value = &sliceDefault{Value: fl.Value, defaults: defaults, appendDefaults: appendDefaults}
+	f.def = f.copyValue()
+	f.defaults = defaults
+	f.appendDefaults = appendDefaults
+
+	if f.alias != "" {
+		alias := fs.fs.Lookup(f.alias)
+		alias.Value, alias.DefValue = fl.Value, fl.DefValue
+	}
+	return nil
+}
+
+// addFromFile wraps the value of the flag to read values starting with @ from
+// the named file, if enabled
+func (fs *FlagSet) addFromFile(f *flg) {
+	if !f.fromFile {
+		return
+	}
+
+	fl := fs.fs.Lookup(f.name)
+	fl.Value = &fileValue{Value: fl.Value, dryRun: fs.dryRun}
+}
+
+// addStdin wraps the value of the flag to read stdin for the value "-", if
+// enabled
+func (fs *FlagSet) addStdin(f *flg) {
+	if !f.stdin {
+		return
+	}
+
+	fl := fs.fs.Lookup(f.name)
+	fl.Value = &stdinValue{Value: fl.Value, dryRun: fs.dryRun}
+}
+
+// addOptional wraps the value of a flag whose value is optional, if enabled
+func (fs *FlagSet) addOptional(f *flg) {
+	if f.optionalValue == nil {
+		return
+	}
+
+	fl := fs.fs.Lookup(f.name)
+	fl.Value = &optionalValue{Value: fl.Value, present: *f.optionalValue}
+}
+
+// addCounter wraps the value of a slice flag to count how many times the flag
+// is given
+func (fs *FlagSet) addCounter(f *flg) {
+	if !f.isSlice() {
+		return
+	}
+
+	fl := fs.fs.Lookup(f.name)
+	fl.Value = &countingValue{Value: fl.Value}
+}
+
+// Occurrences returns how many times the slice flag with the given name or
+// alias was given in the last parse, which differs from the number of values
+// when values are split on commas
+func (fs *FlagSet) Occurrences(name string) (int, error) {
+	f, ok := fs.flags[fs.canonicalName(name)]
+	if !ok {
+		return 0, fmt.Errorf("no such flag -%v", name)
+	}
+	c := findCounter(fs.fs.Lookup(f.name).Value)
+	if c == nil {
+		return 0, fmt.Errorf("flag -%v is not a slice flag", name)
+	}
+	return c.n, nil
+}
+
+func occurrences(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	n, err := gf.Occurrences(L.CheckString(2))
+	if err != nil {
+		L.ArgError(2, err.Error())
+	}
+
+	L.Push(lua.LNumber(n))
+	return 1
+}
+
+// addUnits wraps the value of a numeric flag to accept unit suffixes
+func (fs *FlagSet) addUnits(f *flg) {
+	if f.units == 0 {
+		return
+	}
+
+	fl := fs.fs.Lookup(f.name)
+	fl.Value = &unitValue{Value: fl.Value, base: f.units}
+}
+
+// addBase wraps the value of an integer flag to parse it in the base of the
+// flag, if any
+func (fs *FlagSet) addBase(f *flg) {
+	if f.base == nil {
+		return
+	}
+
+	fl := fs.fs.Lookup(f.name)
+	unsigned := false
+	switch unwrapValue(fl.Value).(flag.Getter).Get().(type) {
+	case uint, uint64:
+		unsigned = true
+	}
+	fl.Value = &baseValue{Value: fl.Value, base: *f.base, unsigned: unsigned}
+}
+
+// canonicalName returns the primary name of a flag given its name or alias
+func (fs *FlagSet) canonicalName(name string) string {
+	if primary, ok := fs.aliases[name]; ok {
+		return primary
+	}
+	return name
+}
+
+// FlagTakesValue reports whether the flag, or alias, name consumes the
+// following argument as its value, which all flags but booleans and counters
+// do. It is false for unknown flags.
+func (fs *FlagSet) FlagTakesValue(name string) bool {
+	if f, ok := fs.flags[fs.canonicalName(name)]; ok {
+		return f.takesValue()
+	}
+	fl := fs.fs.Lookup(name)
+	return fl != nil && !isBoolFlag(fl)
+}
+
+// GoFlagSet returns the underlying flag set, so the host program can define
+// flags in Go next to those defined in Lua. Parse reports the values of flags
+// defined in Go as strings, as returned by the String method of the value.
+// The flag set, and the flags defined in Go, are kept by Reset.
+func (fs *FlagSet) GoFlagSet() *flag.FlagSet {
+	return fs.fs
+}
+
+// flagLValue returns the value of the flag as a lua value, flags not defined
+// from Lua get the string form of their value
+func (fs *FlagSet) flagLValue(L *lua.LState, fl *flag.Flag) lua.LValue {
+	if f, ok := fs.flags[fl.Name]; ok {
+		return f.toLValue(L)
+	}
+	return lua.LString(fl.Value.String())
+}
+
+// Reset restores all flags to their default values and forgets which flags
+// were set, so the flag set can be parsed again
+func (fs *FlagSet) Reset() error {
+	f := flag.NewFlagSet(fs.name, flag.ContinueOnError)
+	f.Usage = fs.fs.Usage
+
+	var err error
+	fs.fs.VisitAll(func(fl *flag.Flag) {
+		if e := resetValue(fl); e != nil && err == nil {
+			err = fmt.Errorf("flag -%v: %v", fl.Name, e)
+		}
+		f.Var(fl.Value, fl.Name, fl.Usage)
+	})
+
+	for _, arg := range fs.arguments {
+		arg.value = lua.LNil
+	}
+
+	// reset in place, so the flag set returned by GoFlagSet stays valid
+	*fs.fs = *f
+	fs.visited = make(map[string]bool)
+	return err
+}
+
+// Validate parses args with a clone of the flag set, without writing usage or
+// warnings to the output, and returns the error parse would return. The
+// values of the flag set itself are left untouched. To be free of side
+// effects no result is built, validate functions and the set functions of
+// custom flags are not called and values are not read from files or stdin, so
+// the errors these would report are not found.
+func (fs *FlagSet) Validate(L *lua.LState, args []string) error {
+	c := fs.clone(true)
+	c.output = ioutil.Discard
+
+	_, err := c.parse(L, args)
+	return err
+}
+
+func validateArgs(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	args := L.CheckTable(2)
+
+	if err := gf.Validate(L, toArgs(args)[1:]); err != nil {
+		L.Push(lua.LFalse)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+
+	L.Push(lua.LTrue)
+	return 1
+}
+
+// Clone returns an independent flag set with the same flags, arguments,
+// subcommands and settings, with the values at their defaults
+func (fs *FlagSet) Clone() *FlagSet {
+	return fs.clone(false)
+}
+
+// clone returns a clone of the flag set, which only checks the values given
+// when dryRun is set, see Validate
+func (fs *FlagSet) clone(dryRun bool) *FlagSet {
+	c := *fs
+	c.dryRun = dryRun
+	c.fs = flag.NewFlagSet(fs.name, flag.ContinueOnError)
+	c.fs.Usage = func() {}
+	c.flags = make(flgs)
+	c.order = nil
+	c.visited = make(map[string]bool)
+	c.aliases = make(map[string]string)
+	c.SetCacheCompletions(fs.compCache != nil)
+
+	for _, name := range fs.order {
+		f := *fs.flags[name]
+		f.value = (&flg{value: f.def}).copyValue()
+		if cv, ok := f.value.(*customValue); ok {
+			cv.dryRun = dryRun
+		}
+		c.define(&f)
+		c.addFlag(&f)
+		c.setSliceDefault(f.name, f.defaults, f.appendDefaults)
+	}
+
+	// flags defined on the Go flag set directly
+	fs.fs.VisitAll(func(fl *flag.Flag) {
+		if c.fs.Lookup(fl.Name) == nil {
+			c.fs.Var(copyGoValue(fl.Value, fl.DefValue), fl.Name, fl.Usage)
+		}
+	})
+
+	c.arguments = make(arguments, 0, len(fs.arguments))
+	for _, arg := range fs.arguments {
+		a := *arg
+		a.value = lua.LNil
+		c.arguments = append(c.arguments, &a)
+	}
+
+	c.commands = make(map[string]*FlagSet)
+	for name, cmd := range fs.commands {
+		c.commands[name] = cmd.clone(dryRun)
+	}
+	c.commandNames = append([]string(nil), fs.commandNames...)
+	c.exclusive = append([][]string(nil), fs.exclusive...)
+	c.together = append([][]string(nil), fs.together...)
+
+	return &c
+}
+
+// define registers the value of the flag, which holds its default
+func (fs *FlagSet) define(f *flg) {
+	switch value := f.value.(type) {
+	case *float64:
+		fs.fs.Float64Var(value, f.name, *value, f.usage)
+	case *string:
+		fs.fs.StringVar(value, f.name, *value, f.usage)
+	case *bool:
+		fs.fs.BoolVar(value, f.name, *value, f.usage)
+	case *int:
+		fs.fs.IntVar(value, f.name, *value, f.usage)
+	case *int64:
+		fs.fs.Int64Var(value, f.name, *value, f.usage)
+	case *uint:
+		fs.fs.UintVar(value, f.name, *value, f.usage)
+	case *uint64:
+		fs.fs.Uint64Var(value, f.name, *value, f.usage)
+	case *time.Duration:
+		fs.fs.DurationVar(value, f.name, *value, f.usage)
+	case flag.Value:
+		fs.fs.Var(value, f.name, f.usage)
+	}
+}
+
+func clone(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+
+	ud := L.NewUserData()
+	ud.Value = gf.Clone()
+	L.SetMetatable(ud, L.GetTypeMetatable(luaFlagSetTypeName))
+
+	L.Push(ud)
+	return 1
+}
+
+func reset(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	if err := gf.Reset(); err != nil {
+		L.RaiseError("%v", err)
+	}
+	return 0
+}
+
+// SetCaseInsensitive makes flag names match regardless of case when parsing
+func (fs *FlagSet) SetCaseInsensitive(b bool) {
+	fs.caseInsensitive = b
+}
+
+func caseInsensitive(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetCaseInsensitive(L.OptBool(2, true))
+	return 0
+}
+
+// SetInterspersed makes parsing accept flags after positional arguments, e.g.
+// `cmd pos -v`. By default parsing stops at the first positional argument and
+// the remaining arguments are positional, even if they start with "-".
+func (fs *FlagSet) SetInterspersed(b bool) {
+	fs.interspersed = b
+}
+
+func interspersed(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetInterspersed(L.OptBool(2, true))
+	return 0
+}
+
+// moveFlagsFirst reorders args so the flags and their values come before the
+// positional arguments, which follow a "--" terminator. Arguments after a
+// "--", a subcommand name or the start of the rest argument keep their place.
+// Undefined flags are assumed to take no value.
+func (fs *FlagSet) moveFlagsFirst(args []string) []string {
+	rest := fs.restStart()
+	var flags, positionals []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positionals = append(positionals, args[i+1:len(args)]...)
+			break
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		_, err := strconv.ParseFloat(arg, 64)
+		if !isFlag(arg) || arg == "-" || (err == nil && fs.fs.Lookup(name) == nil) {
+			// the subcommand parses the arguments following its name
+			if len(fs.commands) > 0 {
+				positionals = append(positionals, args[i:len(args)]...)
+				break
+			}
+			// the rest argument is passed through as given
+			if len(positionals) == rest {
+				positionals = append(positionals, args[i:len(args)]...)
+				break
+			}
+			positionals = append(positionals, arg)
+			continue
+		}
+
+		flags = append(flags, arg)
+		if strings.Contains(name, "=") {
+			continue
+		}
+		if fl := fs.fs.Lookup(name); fl != nil && !isBoolFlag(fl) && i+1 < len(args) {
+			i++
+			flags = append(flags, args[i])
+		}
+	}
+
+	if len(positionals) == 0 {
+		return flags
+	}
+	return append(append(flags, "--"), positionals...)
+}
+
+// restStart returns the number of positional arguments before the rest
+// argument, or -1 if there is no rest argument
+func (fs *FlagSet) restStart() int {
+	n := 0
+	for _, arg := range fs.arguments {
+		if arg.rest {
+			return n
+		}
+		if arg.times > 1 {
+			n += arg.times
+		} else {
+			n++
+		}
+	}
+	return -1
+}
+
+// joinBoolValues joins boolean flags with explicitValue set with a following
+// true or false, e.g. -debug false becomes -debug=false. Any other argument
+// after the flag is left alone, so -debug file keeps file as positional. The
+// flag names must be canonical, see canonicalArgs.
+func (fs *FlagSet) joinBoolValues(args []string) []string {
+	var res []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		res = append(res, arg)
+		if arg == "--" {
+			return append(res, args[i+1:len(args)]...)
+		}
+		if !isFlag(arg) || arg == "-" {
+			if fs.interspersed {
+				continue
+			}
+			return append(res, args[i+1:len(args)]...)
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			continue
+		}
+		fl := fs.fs.Lookup(name)
+		if fl == nil {
+			continue
+		}
+		if !isBoolFlag(fl) {
+			// skip the value
+			if i+1 < len(args) {
+				i++
+				res = append(res, args[i])
+			}
+			continue
+		}
+		if f, ok := fs.flags[fs.canonicalName(name)]; ok && f.explicitValue && i+1 < len(args) {
+			if next := args[i+1]; next == "true" || next == "false" {
+				i++
+				res[len(res)-1] = arg + "=" + next
+			}
+		}
+	}
+	return res
+}
+
+// applyOptionalValues joins the optional value to flags given without a
+// value, e.g. -log becomes -log=default.log, so the flag package does not
+// set them to true
+func (fs *FlagSet) applyOptionalValues(args []string) []string {
+	res := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !isFlag(arg) || arg == "-" {
+			return append(res, args[i:len(args)]...)
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			res = append(res, arg)
+			continue
+		}
+		f, ok := fs.flags[fs.canonicalName(name)]
+		switch {
+		case ok && f.optionalValue != nil:
+			res = append(res, arg+"="+*f.optionalValue)
+		case fs.FlagTakesValue(name) && i+1 < len(args):
+			// skip the value
+			res = append(res, arg, args[i+1])
+			i++
+		default:
+			res = append(res, arg)
+		}
+	}
+	return res
+}
+
+// endFlagsAtNumber inserts the "--" terminator before a negative number in a
+// flag position, so it is parsed as positional argument instead of an
+// unknown flag, if the first positional argument is numeric. Negative numbers
+// as flag values need no handling. The flag names must be canonical, see
+// canonicalArgs.
+func (fs *FlagSet) endFlagsAtNumber(args []string) []string {
+	if len(fs.arguments) == 0 || (fs.arguments[0].typ != "int" && fs.arguments[0].typ != "number") {
+		return args
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !isFlag(arg) || arg == "-" || arg == "--" {
+			return args
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if _, err := strconv.ParseFloat(arg, 64); err == nil && fs.fs.Lookup(name) == nil {
+			res := append([]string{}, args[:i]...)
+			res = append(res, "--")
+			return append(res, args[i:]...)
+		}
+		if strings.Contains(name, "=") {
+			continue
+		}
+
+		// skip the value of non boolean flags
+		if fl := fs.fs.Lookup(name); fl != nil && !isBoolFlag(fl) {
+			i++
+		}
+	}
+	return args
+}
+
+// SetAbbreviations makes parsing accept unambiguous prefixes of flag names,
+// e.g. -ver for -verbose
+func (fs *FlagSet) SetAbbreviations(b bool) {
+	fs.abbreviations = b
+}
+
+func abbreviations(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetAbbreviations(L.OptBool(2, true))
+	return 0
+}
+
+// canonicalArgs rewrites the flags in args to start with "-" or "--" and to
+// use the name they were defined with, resolving the prefix characters, the
+// case and abbreviations as enabled, so the later passes can look them up.
+// Flag values, positional arguments and the arguments of a subcommand or the
+// rest argument are left untouched.
+func (fs *FlagSet) canonicalArgs(args []string) ([]string, error) {
+	rest := fs.restStart()
+	positionals := 0
+
+	res := make([]string, len(args))
+	copy(res, args)
+	for i := 0; i < len(res); i++ {
+		arg := res[i]
+		if arg == "--" {
+			break
+		}
+
+		fl, canonical, err := fs.resolveFlag(arg)
+		if err != nil {
+			return nil, err
+		}
+		if fl == nil {
+			// undefined flags are assumed to take no value
+			if _, err := strconv.ParseFloat(arg, 64); isFlag(arg) && arg != "-" && err != nil {
+				continue
+			}
+			if !fs.interspersed || len(fs.commands) > 0 || positionals == rest {
+				break
+			}
+			positionals++
+			continue
+		}
+
+		res[i] = canonical
+		// skip the value of non boolean flags
+		if !strings.Contains(canonical, "=") && !isBoolFlag(fl) {
+			i++
+		}
+	}
+
+	return res, nil
+}
+
+// resolveFlag returns the flag named by arg and arg rewritten to start with
+// "-", or "--" if given so, and the name the flag was defined with. The flag
+// is nil if arg names none, ambiguous abbreviations are an error.
+func (fs *FlagSet) resolveFlag(arg string) (*flag.Flag, string, error) {
+	var dashes, name string
+	switch {
+	case arg == "-" || arg == "--":
+		return nil, arg, nil
+	case strings.HasPrefix(arg, "--"):
+		dashes, name = "--", arg[2:len(arg)]
+	case isFlag(arg):
+		dashes, name = "-", arg[1:len(arg)]
+	case len(arg) > 1 && strings.IndexByte(fs.prefix, arg[0]) >= 0:
+		dashes, name = "-", arg[1:len(arg)]
+	default:
+		return nil, arg, nil
+	}
+
+	value := ""
+	if i := strings.Index(name, "="); i >= 0 {
+		name, value = name[:i], name[i:len(name)]
+	}
+
+	fl := fs.fs.Lookup(name)
+	if fl == nil && fs.caseInsensitive {
+		fs.fs.VisitAll(func(f *flag.Flag) {
+			if fl == nil && strings.EqualFold(f.Name, name) {
+				fl = f
+			}
+		})
+	}
+	if fl == nil && fs.abbreviations {
+		var matches []string
+		for _, f := range fs.usageFlags() {
+			if strings.HasPrefix(f.Name, name) || (fs.caseInsensitive && strings.HasPrefix(strings.ToLower(f.Name), strings.ToLower(name))) {
+				matches = append(matches, f.Name)
+			}
+		}
+		sort.Strings(matches)
+
+		switch {
+		case len(matches) == 1:
+			fl = fs.fs.Lookup(matches[0])
+		case len(matches) > 1 && isFlag(arg):
+			return nil, arg, fmt.Errorf("ambiguous flag %v%v: could be -%v", dashes, name, strings.Join(matches, ", -"))
+		}
+	}
+	if fl == nil {
+		return nil, arg, nil
+	}
+	return fl, dashes + fl.Name + value, nil
+}
+
+// AddCommand registers a subcommand, parsing dispatches to the flag set of
+// the command when the first positional argument is its name. The parse
+// result holds the name of the matched command under "command" and its
+// result under the name, so neither can be the name of a flag or argument.
+func (fs *FlagSet) AddCommand(name string, cmd *FlagSet) error {
+	for _, n := range []string{"command", name} {
+		if fs.fs.Lookup(n) != nil {
+			return fmt.Errorf("command %q collides with flag %q", name, n)
+		}
+		for _, a := range fs.arguments {
+			if a.name == n {
+				return fmt.Errorf("command %q collides with argument %q", name, n)
+			}
+		}
+	}
+
+	if _, ok := fs.commands[name]; !ok {
+		fs.commandNames = append(fs.commandNames, name)
+	}
+	fs.commands[name] = cmd
+	return nil
+}
+
+func command(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	name := L.CheckString(2)
+	cmd := checkFlagSet(L, 3)
+
+	if err := gf.AddCommand(name, cmd); err != nil {
+		L.RaiseError("%v", err)
+	}
+
+	L.Push(L.Get(3))
+	return 1
+}
+
+// SetLongFlags makes completion offer flags with a GNU style "--" prefix.
+// Parsing accepts both "-name" and "--name" regardless, as does the flag
+// package, and a bare "--" still terminates the flags.
+func (fs *FlagSet) SetLongFlags(b bool) {
+	fs.longFlags = b
+}
+
+func longFlags(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetLongFlags(L.OptBool(2, true))
+	return 0
+}
+
+// flagPrefix returns the prefix flags are presented with
+func (fs *FlagSet) flagPrefix() string {
+	if fs.prefix != "" {
+		return fs.prefix[:1]
+	}
+	if fs.longFlags {
+		return "--"
+	}
+	return "-"
+}
+
+// SetFlagPrefix sets the characters that start a flag in addition to "-",
+// e.g. "/" for Windows style /name. The first character is used in the usage
+// message and completion. Only arguments naming a defined flag are taken as
+// flags, so /tmp/file is still a positional argument.
+func (fs *FlagSet) SetFlagPrefix(prefix string) {
+	fs.prefix = prefix
+}
+
+func flagPrefix(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetFlagPrefix(L.CheckString(2))
+	return 0
+}
+
+// isFlagWord reports whether the word starts like a flag, with "-" or one of
+// the prefix characters. A word starting with the path separator "/" is only
+// a flag if it is the start of a defined flag name, so paths are not.
+func (fs *FlagSet) isFlagWord(word string) bool {
+	if isFlag(word) {
+		return true
+	}
+	if len(word) == 0 || strings.IndexByte(fs.prefix, word[0]) < 0 {
+		return false
+	}
+	if word[0] != '/' {
+		return true
+	}
+
+	name := word[1:len(word)]
+	if i := strings.Index(name, "="); i >= 0 {
+		name = name[:i]
+	}
+	if strings.Contains(name, "/") {
+		return false
+	}
+	matched := false
+	fs.fs.VisitAll(func(fl *flag.Flag) {
+		matched = matched || strings.HasPrefix(fl.Name, name)
+	})
+	return matched
+}
+
+// normalizePrefix rewrites flags starting with one of the prefix characters
+// to start with "-"
+func (fs *FlagSet) normalizePrefix(args []string) []string {
+	res := make([]string, len(args))
+	copy(res, args)
+	for i := 0; i < len(res); i++ {
+		arg := res[i]
+		if arg == "--" {
+			break
+		}
+		if len(arg) > 1 && strings.IndexByte(fs.prefix, arg[0]) >= 0 && arg[0] != '-' {
+			name := arg[1:len(arg)]
+			if j := strings.Index(name, "="); j >= 0 {
+				name = name[:j]
+			}
+			if fs.fs.Lookup(name) != nil {
+				arg = "-" + arg[1:len(arg)]
+				res[i] = arg
+			}
+		}
+		if !isFlag(arg) || arg == "-" {
+			if fs.interspersed {
+				continue
+			}
+			break
+		}
+
+		// skip the value of non boolean flags
+		name := strings.TrimLeft(arg, "-")
+		if fl := fs.fs.Lookup(name); fl != nil && !isBoolFlag(fl) {
+			i++
+		}
+	}
+	return res
+}
+
+// SetResponseFiles makes parsing replace arguments of the form @file with
+// the whitespace separated words of the file, which may refer to other files
+func (fs *FlagSet) SetResponseFiles(b bool) {
+	fs.responseFiles = b
+}
+
+func responseFiles(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetResponseFiles(L.OptBool(2, true))
+	return 0
+}
+
+// expandResponseFiles splices the contents of @file arguments into args,
+// seen holds the files being expanded to detect cycles
+func expandResponseFiles(args []string, seen map[string]bool) ([]string, error) {
+	if seen == nil {
+		seen = make(map[string]bool)
+	}
+
+	var res []string
+	for _, arg := range args {
+		if len(arg) < 2 || arg[0] != '@' {
+			res = append(res, arg)
+			continue
+		}
+
+		name := arg[1:]
+		if seen[name] {
+			return nil, fmt.Errorf("response file %v includes itself", name)
+		}
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, fmt.Errorf("reading response file: %v", err)
+		}
+
+		seen[name] = true
+		words, err := expandResponseFiles(strings.Fields(string(b)), seen)
+		if err != nil {
+			return nil, err
+		}
+		delete(seen, name)
+		res = append(res, words...)
+	}
+	return res, nil
+}
+
+// SetIgnoreUnknown makes parsing collect undefined flags instead of failing
+func (fs *FlagSet) SetIgnoreUnknown(b bool) {
+	fs.ignoreUnknown = b
+}
+
+func ignoreUnknown(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetIgnoreUnknown(L.OptBool(2, true))
+	return 0
+}
+
+// splitUnknown separates the flags that are not defined from args
+func (fs *FlagSet) splitUnknown(args []string) (known []string, unknown []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !isFlag(arg) || arg == "-" || arg == "--" {
+			return append(known, args[i:len(args)]...), unknown
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		value := false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value = name[:j], true
+		}
+
+		fl := fs.fs.Lookup(name)
+		if fl == nil {
+			unknown = append(unknown, arg)
+			continue
+		}
+
+		known = append(known, arg)
+		if !value && !isBoolFlag(fl) && i+1 < len(args) {
+			i++
+			known = append(known, args[i])
+		}
+	}
+	return known, unknown
+}
+
+// SetOrderedUsage makes the usage list flags in registration order instead
+// of sorted by name
+func (fs *FlagSet) SetOrderedUsage(b bool) {
+	fs.orderedUsage = b
+}
+
+func orderedUsage(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetOrderedUsage(L.OptBool(2, true))
+	return 0
+}
+
+func sortFlags(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetOrderedUsage(!L.OptBool(2, true))
+	return 0
+}
+
+// SetUsageWidth sets the width the usage text is wrapped at, zero uses the
+// COLUMNS environment variable or 80 and a negative width disables wrapping
+func (fs *FlagSet) SetUsageWidth(width int) {
+	fs.usageWidth = width
+}
+
+func (fs *FlagSet) width() int {
+	if fs.usageWidth != 0 {
+		return fs.usageWidth
+	}
+	if columns, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && columns > 0 {
+		return columns
+	}
+	return 80
+}
+
+func usageWidth(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetUsageWidth(L.CheckInt(2))
+	return 0
+}
+
+// SetCollectRest makes parsing collect arguments beyond the defined
+// positional arguments under "rest" instead of failing
+func (fs *FlagSet) SetCollectRest(b bool) {
+	fs.collectRest = b
+}
+
+func collectRest(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetCollectRest(L.OptBool(2, true))
+	return 0
+}
+
+// SetErrorUsage sets what is written to the output when parsing a flag fails
+// and parse in Lua raises the error, one of "full" for the complete usage,
+// "short" for the one line usage or "none". Returned errors are not written.
+func (fs *FlagSet) SetErrorUsage(mode string) error {
+	switch mode {
+	case "full", "short", "none":
+		fs.errorUsage = mode
+		return nil
+	}
+	return fmt.Errorf("usage mode should be one of 'full', 'short', or 'none'")
+}
+
+func (fs *FlagSet) writeErrorUsage() {
+	switch fs.errorUsage {
+	case "full":
+		fmt.Fprint(fs.output, fs.Usage())
+	case "short":
+		fmt.Fprintf(fs.output, "usage: %v\n", fs.ShortUsage())
+	}
+}
+
+func usageOnError(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	if err := gf.SetErrorUsage(L.CheckString(2)); err != nil {
+		L.ArgError(2, err.Error())
+	}
+	return 0
+}
+
+// SetDefault overrides the default value of a flag, values from the command
+// line still take precedence. Slice flags append the value to the default.
+func (fs *FlagSet) SetDefault(name, value string) error {
+	fl := fs.fs.Lookup(name)
+	if fl == nil {
+		return fmt.Errorf("no such flag -%v", name)
+	}
+	if err := fl.Value.Set(value); err != nil {
+		return fmt.Errorf("invalid default value %q for flag -%v: %v", value, name, err)
+	}
+	fl.DefValue = fl.Value.String()
+	if f, ok := fs.flags[name]; ok {
+		f.def = f.copyValue()
+		if f.alias != "" {
+			fs.fs.Lookup(f.alias).DefValue = fl.DefValue
+		}
+	}
+	return nil
+}
+
+// Default returns the default value of the flag, typed as returned by parse
+func (fs *FlagSet) Default(L *lua.LState, name string) (lua.LValue, error) {
+	f, ok := fs.flags[fs.canonicalName(name)]
+	if !ok {
+		return lua.LNil, fmt.Errorf("no such flag -%v", name)
+	}
+	def := &flg{value: f.def}
+	return def.toLValue(L), nil
+}
+
+func defaultValue(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	name := L.CheckString(2)
+
+	def, err := gf.Default(L, name)
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+
+	L.Push(def)
+	return 1
+}
+
+func defaults(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	values := L.CheckTable(2)
+
+	values.ForEach(func(k, v lua.LValue) {
+		name := k.String()
+		f, ok := gf.flags[gf.canonicalName(name)]
+		if !ok {
+			L.RaiseError("no such flag -%v", name)
+		}
+
+		var err error
+		switch value := v.(type) {
+		case *lua.LTable:
+			if !f.isSlice() && f.typeName() != "keyvalue" {
+				L.RaiseError("invalid default value for flag -%v: expected %v, got table", name, f.typeName())
+			}
+			// replaced by the values from the command line, as the default option
+			if f.isSlice() && value.Len() > 0 {
+				err = gf.setSliceDefault(f.name, toStringSlice(value), f.appendDefaults)
+				break
+			}
+			unwrapValue(gf.fs.Lookup(f.name).Value).(resetter).reset("")
+			value.ForEach(func(key, elem lua.LValue) {
+				if err != nil {
+					return
+				}
+				if _, isIndex := key.(lua.LNumber); isIndex {
+					err = gf.SetDefault(f.name, elem.String())
+				} else {
+					err = gf.SetDefault(f.name, key.String()+"="+elem.String())
+				}
+			})
+		case lua.LNumber:
+			if _, ok := f.value.(*time.Duration); ok {
+				err = gf.SetDefault(f.name, toDuration(L, value).String())
+				break
+			}
+			err = gf.SetDefault(f.name, value.String())
+		default:
+			err = gf.SetDefault(f.name, value.String())
+		}
+		if err != nil {
+			L.RaiseError("%v", err)
+		}
+	})
+
+	return 0
+}
+
+func narg(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	if !gf.fs.Parsed() {
+		L.RaiseError("narg called before parse")
+	}
+	L.Push(lua.LNumber(gf.fs.NArg()))
+	return 1
+}
+
+func nflag(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	if !gf.fs.Parsed() {
+		L.RaiseError("nflag called before parse")
+	}
+	L.Push(lua.LNumber(gf.fs.NFlag()))
+	return 1
+}
+
+func setUsage(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	fn := L.CheckFunction(2)
+
+	gf.SetUsageFunc(func(fs *FlagSet) string {
+		if err := L.CallByParam(lua.P{
+			Fn:      fn,
+			NRet:    1,
+			Protect: true,
+		}, fs.usageTable(L)); err != nil {
+			reraise(L, err)
+		}
+		res := L.Get(-1)
+		L.Pop(1)
+		return lua.LVAsString(res)
+	})
+	return 0
+}
+
+// usageTable returns the data used to build the usage as a lua table, with
+// the flags in the same order as the built-in usage
+func (fs *FlagSet) usageTable(L *lua.LState) *lua.LTable {
+	flags := L.NewTable()
+	for _, fl := range fs.usageFlags() {
+		def, ok := fs.flags[fl.Name]
+		if !ok {
+			continue
+		}
+		f := fs.flagInfo(def)
+		t := L.NewTable()
+		t.RawSetString("name", lua.LString(f.Name))
+		t.RawSetString("alias", lua.LString(f.Alias))
+		t.RawSetString("type", lua.LString(f.Type))
+		t.RawSetString("usage", lua.LString(f.Usage))
+		t.RawSetString("default", lua.LString(f.Default))
+		t.RawSetString("required", lua.LBool(f.Required))
+		t.RawSetString("slice", lua.LBool(f.Slice))
+		flags.Append(t)
+	}
+
+	args := L.NewTable()
+	for _, a := range fs.Arguments() {
+		t := L.NewTable()
+		t.RawSetString("name", lua.LString(a.Name))
+		t.RawSetString("type", lua.LString(a.Type))
+		t.RawSetString("usage", lua.LString(a.Usage))
+		t.RawSetString("default", lua.LString(a.Default))
+		t.RawSetString("slice", lua.LBool(a.Slice))
+		args.Append(t)
+	}
+
+	t := L.NewTable()
+	t.RawSetString("name", lua.LString(fs.name))
+	t.RawSetString("short", lua.LString(fs.ShortUsage()))
+	t.RawSetString("flags", flags)
+	t.RawSetString("arguments", args)
+	return t
+}
+
+// SetOutput sets the destination for usage and error messages written
+// during parsing, os.Stderr is used by default
+func (fs *FlagSet) SetOutput(w io.Writer) {
+	fs.output = w
+}
+
+func setOutput(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	fn := L.CheckFunction(2)
+
+	gf.SetOutput(&luaWriter{L: L, fn: fn})
+	return 0
+}
+
+// IsSet reports whether the flag, or alias, name was explicitly set during
+// the last parse
+func (fs *FlagSet) IsSet(name string) bool {
+	return fs.visited[fs.canonicalName(name)]
+}
+
+func isSet(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	name := L.CheckString(2)
+
+	L.Push(lua.LBool(gf.IsSet(name)))
+	return 1
+}
+
+// checkRequired returns an error listing all required flags that were not set
+func (fs *FlagSet) checkRequired() error {
+	var missing []string
+	for name, f := range fs.flags {
+		if f.required && !fs.visited[name] {
+			missing = append(missing, "-"+name)
+		}
+	}
+
+	switch len(missing) {
+	case 0:
+		return nil
+	case 1:
+		err := fmt.Errorf("flag %v is required", missing[0])
+		return &ParseError{Kind: KindMissingRequired, Err: err, Flag: missing[0][1:len(missing[0])]}
+	}
+
+	sort.Strings(missing)
+	return fmt.Errorf("flags %v are required", strings.Join(missing, ", "))
+}
+
+// Deprecate marks a flag as deprecated, the message is written to the output
+// when the flag is used
+func (fs *FlagSet) Deprecate(name, message string) error {
+	f, ok := fs.flags[name]
+	if !ok {
+		return fmt.Errorf("no such flag -%v", name)
+	}
+	f.deprecated = message
+	return nil
+}
+
+func (fs *FlagSet) warnDeprecated() {
+	for _, name := range fs.order {
+		if f := fs.flags[name]; f.deprecated != "" && fs.visited[name] {
+			fmt.Fprintf(fs.output, "flag -%v is deprecated: %v\n", name, f.deprecated)
+		}
+	}
+}
+
+func deprecated(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	name := L.CheckString(2)
+	message := L.CheckString(3)
+
+	if err := gf.Deprecate(name, message); err != nil {
+		L.ArgError(2, err.Error())
+	}
+	return 0
+}
+
+// AddExclusive adds a group of flags of which at most one may be set
+func (fs *FlagSet) AddExclusive(names []string) error {
+	for _, name := range names {
+		if _, ok := fs.flags[name]; !ok {
+			return fmt.Errorf("no such flag -%v", name)
+		}
+	}
+	fs.exclusive = append(fs.exclusive, names)
+	return nil
+}
+
+// runValidators calls the validate function of each flag with its parsed value,
+// or with every element of slice flags. Any result but true is an error.
+// Validation stops at the first error unless errors are collected.
+func (fs *FlagSet) runValidators(L *lua.LState, t *lua.LTable) []error {
+	var errs []error
+	for _, name := range fs.order {
+		f := fs.flags[name]
+		if f.validate == nil {
+			continue
+		}
+
+		values := []lua.LValue{t.RawGetString(name)}
+		if f.isSlice() {
+			values = values[:0]
+			t.RawGetString(name).(*lua.LTable).ForEach(func(_, v lua.LValue) {
+				values = append(values, v)
+			})
+		}
+
+		for _, v := range values {
+			if err := fs.callValidator(L, f, v); err != nil {
+				errs = append(errs, &ParseError{Kind: KindValidation, Err: err, Flag: f.name})
+				if !fs.collectErrors {
+					return errs
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+// callValidator calls the validate function of the flag with the value
+func (fs *FlagSet) callValidator(L *lua.LState, f *flg, v lua.LValue) error {
+	if err := L.CallByParam(lua.P{Fn: f.validate, NRet: 1, Protect: true}, v); err != nil {
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			return fmt.Errorf("invalid value %q for flag -%v: %v", v.String(), f.name, apiErr.Object)
+		}
+		return fmt.Errorf("invalid value %q for flag -%v: %v", v.String(), f.name, err)
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+
+	if ret == lua.LTrue {
+		return nil
+	}
+	msg := "validation failed"
+	if s, ok := ret.(lua.LString); ok {
+		msg = string(s)
+	}
+	return fmt.Errorf("invalid value %q for flag -%v: %v", v.String(), f.name, msg)
+}
+
+// checkFlags runs the checks on the parsed flags, stopping at the first
+// failing check unless errors are collected
+func (fs *FlagSet) checkFlags(L *lua.LState, t *lua.LTable) error {
+	var errs []*ParseError
+	add := func(kind ErrorKind, err error) bool {
+		if perr, ok := err.(*ParseError); ok {
+			errs = append(errs, perr)
+		} else if err != nil {
+			errs = append(errs, &ParseError{Kind: kind, Err: err})
+		}
+		return len(errs) == 0 || fs.collectErrors
+	}
+
+	if add(KindMissingRequired, fs.checkRequired()) &&
+		add(KindExclusive, fs.checkExclusive()) &&
+		add(KindRequiredTogether, fs.checkTogether()) && !fs.dryRun {
+		for _, err := range fs.runValidators(L, t) {
+			add(KindValidation, err)
+		}
+	}
+
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return &ParseError{Kind: KindMultiple, Err: fmt.Errorf("%v", strings.Join(msgs, "\n")), Errors: errs}
+}
+
+// SetCollectErrors makes parsing run all checks of the parsed flags, such as
+// required flags and validators, and report all failures together instead
+// of only the first. Errors of the command line syntax still stop parsing.
+func (fs *FlagSet) SetCollectErrors(b bool) {
+	fs.collectErrors = b
+}
+
+func collectErrors(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetCollectErrors(L.OptBool(2, true))
+	return 0
+}
+
+// checkExclusive returns an error if more than one flag of an exclusive group
+// was set
+func (fs *FlagSet) checkExclusive() error {
+	for _, group := range fs.exclusive {
+		var set []string
+		for _, name := range group {
+			if fs.visited[name] {
+				set = append(set, "-"+name)
+			}
+		}
+		if len(set) > 1 {
+			return fmt.Errorf("flags %v are mutually exclusive", strings.Join(set, ", "))
+		}
+	}
+	return nil
+}
+
+// AddRequiredTogether adds a group of flags that must all be set if any of
+// them is set
+func (fs *FlagSet) AddRequiredTogether(names []string) error {
+	for _, name := range names {
+		if _, ok := fs.flags[name]; !ok {
+			return fmt.Errorf("no such flag -%v", name)
+		}
+	}
+	fs.together = append(fs.together, names)
+	return nil
+}
+
+// checkTogether returns an error listing the missing flags of a group that
+// is only partially set
+func (fs *FlagSet) checkTogether() error {
+	for _, group := range fs.together {
+		var set, missing []string
+		for _, name := range group {
+			if fs.visited[name] {
+				set = append(set, "-"+name)
+			} else {
+				missing = append(missing, "-"+name)
+			}
+		}
+		if len(set) > 0 && len(missing) > 0 {
+			return fmt.Errorf("flags %v are required together with %v", strings.Join(missing, ", "), strings.Join(set, ", "))
+		}
+	}
+	return nil
+}
+
+func requiredTogether(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	names := toStringSlice(L.CheckTable(2))
+
+	if err := gf.AddRequiredTogether(names); err != nil {
+		L.ArgError(2, err.Error())
+	}
+	return 0
+}
+
+func exclusive(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	names := toStringSlice(L.CheckTable(2))
+
+	if err := gf.AddExclusive(names); err != nil {
+		L.ArgError(2, err.Error())
+	}
+	return 0
+}
+
+func usage(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	L.Push(lua.LString(gf.Usage()))
+	return 1
+}
+
+// printUsage calls the given function with each line of the usage message, in
+// order and without the trailing newline
+func printUsage(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	fn := L.CheckFunction(2)
+
+	for _, line := range strings.Split(strings.TrimSuffix(gf.Usage(), "\n"), "\n") {
+		if err := L.CallByParam(lua.P{
+			Fn:      fn,
+			NRet:    0,
+			Protect: true,
+		}, lua.LString(line)); err != nil {
+			reraise(L, err)
+		}
+	}
+	return 0
+}
+
+func body(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	L.Push(lua.LString(gf.Body()))
+	return 1
+}
+
+func compgen(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	compCWords := L.CheckInt(2)
+	compWords := L.CheckTable(3)
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	comp, err := gf.CompgenFormat(L, compCWords, toArgs(compWords), L.OptString(4, "bash"))
+	if err != nil {
+		L.ArgError(4, err.Error())
+	}
+
+	L.Push(toTable(L, comp))
+	return 1
+}
+
+func number(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	value := L.CheckNumber(3)
+	usage := L.CheckString(4)
+	opts := optFlagOptions(L, 5, noCompletions(L))
+
+	if err := checkBounds(name, float64(value), opts.min, opts.max); err != nil {
+		L.ArgError(3, err.Error())
+	}
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	f := float64(value)
+	gf.register(L, &flg{
+		name:  name,
+		value: &f,
+		usage: usage,
+		min:   opts.min,
+		max:   opts.max,
+		units: opts.units,
+	}, opts)
+
+	L.Push(gf.flags[name].userdata(L))
+	return 1
+}
+
+func numbers(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	usage := L.CheckString(3)
+	opts := optFlagOptions(L, 4, noCompletions(L))
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	var numbers numberslice
+	gf.register(L, &flg{
+		name:  name,
+		value: &numbers,
+		usage: usage,
+		split: opts.split,
+	}, opts)
+	if err := gf.setSliceDefault(name, opts.defaults, opts.appendDefaults); err != nil {
+		L.ArgError(4, err.Error())
+	}
+
+	return 0
+}
+
+// float32Number registers a float32 flag, values are reported with float32
+// precision
+func float32Number(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	value := L.CheckNumber(3)
+	usage := L.CheckString(4)
+	opts := optFlagOptions(L, 5, noCompletions(L))
+
+	if err := checkBounds(name, float64(value), opts.min, opts.max); err != nil {
+		L.ArgError(3, err.Error())
+	}
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	f := float32Value(value)
+	gf.register(L, &flg{
+		name:  name,
+		value: &f,
+		usage: usage,
+		min:   opts.min,
+		max:   opts.max,
+		units: opts.units,
+	}, opts)
+
+	L.Push(gf.flags[name].userdata(L))
+	return 1
+}
+
+func float32Numbers(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	usage := L.CheckString(3)
+	opts := optFlagOptions(L, 4, noCompletions(L))
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	var numbers float32slice
+	gf.register(L, &flg{
+		name:  name,
+		value: &numbers,
+		usage: usage,
+		split: opts.split,
+	}, opts)
+	if err := gf.setSliceDefault(name, opts.defaults, opts.appendDefaults); err != nil {
+		L.ArgError(4, err.Error())
+	}
+
+	return 0
+}
+
+func integer(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	value := L.CheckInt(3)
+	usage := L.CheckString(4)
+	opts := optFlagOptions(L, 5, noCompletions(L))
+
+	if err := checkBounds(name, float64(value), opts.min, opts.max); err != nil {
+		L.ArgError(3, err.Error())
+	}
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	f := int(value)
+	gf.register(L, &flg{
+		name:  name,
+		value: &f,
+		usage: usage,
+		min:   opts.min,
+		max:   opts.max,
+		units: opts.units,
+		base:  opts.base,
+	}, opts)
+
+	return 0
+}
+
+// integer64 registers an int64 flag, values that can not be represented
+// exactly as a lua number are returned as strings
+func integer64(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	value := L.CheckNumber(3)
+	usage := L.CheckString(4)
+	opts := optFlagOptions(L, 5, noCompletions(L))
+
+	if err := checkBounds(name, float64(value), opts.min, opts.max); err != nil {
+		L.ArgError(3, err.Error())
+	}
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	f := int64(value)
+	gf.register(L, &flg{
+		name:  name,
+		value: &f,
+		usage: usage,
+		min:   opts.min,
+		max:   opts.max,
+		units: opts.units,
+		base:  opts.base,
+	}, opts)
+
+	return 0
+}
+
+// uinteger registers an uint flag, values that can not be represented
+// exactly as a lua number are returned as strings
+func uinteger(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	value := L.CheckNumber(3)
+	usage := L.CheckString(4)
+	opts := optFlagOptions(L, 5, noCompletions(L))
+
+	if err := checkBounds(name, float64(value), opts.min, opts.max); err != nil {
+		L.ArgError(3, err.Error())
+	}
+
+	if value < 0 {
+		L.ArgError(3, "expected unsigned integer")
+	}
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	f := uint(value)
+	gf.register(L, &flg{
+		name:  name,
+		value: &f,
+		usage: usage,
+		min:   opts.min,
+		max:   opts.max,
+		units: opts.units,
+		base:  opts.base,
+	}, opts)
+
+	return 0
+}
+
+// uinteger64 registers an uint64 flag, values that can not be represented
+// exactly as a lua number are returned as strings
+func uinteger64(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	value := L.CheckNumber(3)
+	usage := L.CheckString(4)
+	opts := optFlagOptions(L, 5, noCompletions(L))
+
+	if err := checkBounds(name, float64(value), opts.min, opts.max); err != nil {
+		L.ArgError(3, err.Error())
+	}
+
+	if value < 0 {
+		L.ArgError(3, "expected unsigned integer")
+	}
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	f := uint64(value)
+	gf.register(L, &flg{
+		name:  name,
+		value: &f,
+		usage: usage,
+		min:   opts.min,
+		max:   opts.max,
+		units: opts.units,
+		base:  opts.base,
+	}, opts)
+
+	return 0
+}
+
+// port registers a network port flag, values must be between 1 and 65535,
+// or 0 as well with anyPort set
+func port(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	value := L.CheckInt(3)
+	usage := L.CheckString(4)
+	opts := optFlagOptions(L, 5, noCompletions(L))
+
+	if _, err := parsePort(strconv.Itoa(value), opts.anyPort); err != nil {
+		L.ArgError(3, err.Error())
+	}
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	p := &portValue{port: value, anyPort: opts.anyPort}
+	gf.register(L, &flg{
+		name:  name,
+		value: p,
+		usage: usage,
+	}, opts)
+
+	return 0
+}
+
+func ports(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	usage := L.CheckString(3)
+	opts := optFlagOptions(L, 4, noCompletions(L))
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	p := &portslice{anyPort: opts.anyPort}
+	gf.register(L, &flg{
+		name:  name,
+		value: p,
+		usage: usage,
+		split: opts.split,
+	}, opts)
+	if err := gf.setSliceDefault(name, opts.defaults, opts.appendDefaults); err != nil {
+		L.ArgError(4, err.Error())
+	}
+
+	return 0
+}
+
+func integers(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	usage := L.CheckString(3)
+	opts := optFlagOptions(L, 4, noCompletions(L))
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	var ints intslice
+	gf.register(L, &flg{
+		name:  name,
+		value: &ints,
+		usage: usage,
+		split: opts.split,
+	}, opts)
+	if err := gf.setSliceDefault(name, opts.defaults, opts.appendDefaults); err != nil {
+		L.ArgError(4, err.Error())
+	}
+
+	return 0
+}
+
+func str(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	value := L.CheckString(3)
+	usage := L.CheckString(4)
+	opts := optFlagOptions(L, 5, noCompletions(L))
+
+	if value != "" && opts.pattern != nil && !opts.pattern.MatchString(value) {
+		L.ArgError(3, patternError(name, value, opts.pattern).Error())
+	}
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	f := value
+	gf.register(L, &flg{
+		name:          name,
+		value:         &f,
+		usage:         usage,
+		pattern:       opts.pattern,
+		fromFile:      opts.fromFile,
+		stdin:         opts.stdin,
+		optionalValue: opts.optionalValue,
+	}, opts)
+
+	return 0
+}
+
+func strs(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	usage := L.CheckString(3)
+	opts := optFlagOptions(L, 4, noCompletions(L))
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	var strs stringslice
+	gf.register(L, &flg{
+		name:     name,
+		value:    &strs,
+		usage:    usage,
+		split:    opts.split,
+		pattern:  opts.pattern,
+		fromFile: opts.fromFile,
+	}, opts)
+	if err := gf.setSliceDefault(name, opts.defaults, opts.appendDefaults); err != nil {
+		L.ArgError(4, err.Error())
+	}
+
+	return 0
 }
 
-func compgen(L *lua.LState) int {
+// duration registers a time.Duration flag. The default may be given as a
+// duration string, e.g. "5s", or as a number of seconds. The parsed value is
+// returned to Lua as a number of nanoseconds.
+func duration(L *lua.LState) int {
 	ud := L.CheckUserData(1)
-	compCWords := L.CheckInt(2)
-	compWords := L.CheckTable(3)
+	name := L.CheckString(2)
+	value := toDuration(L, L.CheckAny(3))
+	usage := L.CheckString(4)
+	opts := optFlagOptions(L, 5, noCompletions(L))
 
 	gf, ok := ud.Value.(*FlagSet)
 	if !ok {
 		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
 	}
 
-	comp := gf.Compgen(L, compCWords, toStringSlice(compWords))
+	f := value
+	gf.register(L, &flg{
+		name:  name,
+		value: &f,
+		usage: usage,
+	}, opts)
 
-	L.Push(toTable(L, comp))
-	return 1
+	return 0
 }
 
-func number(L *lua.LState) int {
+func durations(L *lua.LState) int {
 	ud := L.CheckUserData(1)
 	name := L.CheckString(2)
-	value := L.CheckNumber(3)
-	usage := L.CheckString(4)
-	cf := L.OptFunction(5, L.NewFunction(func(L *lua.LState) int {
-		L.Push(lua.LString(""))
-		return 1
-	}))
+	usage := L.CheckString(3)
+	opts := optFlagOptions(L, 4, noCompletions(L))
 
 	gf, ok := ud.Value.(*FlagSet)
 	if !ok {
 		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
 	}
 
-	f := gf.fs.Float64(name, float64(value), usage)
-	gf.flags[name] = &flg{
-		name:   name,
-		value:  f,
-		usage:  usage,
-		compFn: cf,
+	var durations durationslice
+	gf.register(L, &flg{
+		name:  name,
+		value: &durations,
+		usage: usage,
+		split: opts.split,
+	}, opts)
+	if err := gf.setSliceDefault(name, opts.defaults, opts.appendDefaults); err != nil {
+		L.ArgError(4, err.Error())
 	}
 
-	L.Push(gf.flags[name].userdata(L))
-	return 1
+	return 0
 }
 
-func numbers(L *lua.LState) int {
+// keyvalue registers a flag collecting key=value pairs into a table, when a
+// key is given more than once the last value is used
+func keyvalue(L *lua.LState) int {
 	ud := L.CheckUserData(1)
 	name := L.CheckString(2)
 	usage := L.CheckString(3)
-	cf := L.OptFunction(4, L.NewFunction(func(L *lua.LState) int {
-		L.Push(lua.LString(""))
-		return 1
-	}))
+	opts := optFlagOptions(L, 4, noCompletions(L))
 
 	gf, ok := ud.Value.(*FlagSet)
 	if !ok {
 		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
 	}
 
-	var numbers numberslice
-	gf.fs.Var(&numbers, name, usage)
-	gf.flags[name] = &flg{
-		name:   name,
-		value:  &numbers,
-		usage:  usage,
-		compFn: cf,
-	}
+	var kv keyvalues
+	gf.register(L, &flg{
+		name:  name,
+		value: &kv,
+		usage: usage,
+	}, opts)
 
 	return 0
 }
 
-func integer(L *lua.LState) int {
+func boolean(L *lua.LState) int {
 	ud := L.CheckUserData(1)
 	name := L.CheckString(2)
-	value := L.CheckInt(3)
+	value := L.CheckBool(3)
 	usage := L.CheckString(4)
-	cf := L.OptFunction(5, L.NewFunction(func(L *lua.LState) int {
-		L.Push(lua.LString(""))
-		return 1
-	}))
+	opts := optFlagOptions(L, 5, nil)
 
 	gf, ok := ud.Value.(*FlagSet)
 	if !ok {
 		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
 	}
 
-	f := gf.fs.Int(name, int(value), usage)
-	gf.flags[name] = &flg{
-		name:   name,
-		value:  f,
-		usage:  usage,
-		compFn: cf,
-	}
+	f := value
+	gf.register(L, &flg{
+		name:          name,
+		value:         &f,
+		usage:         usage,
+		explicitValue: opts.explicitValue,
+	}, opts)
 
 	return 0
 }
 
-func integers(L *lua.LState) int {
+func booleans(L *lua.LState) int {
 	ud := L.CheckUserData(1)
 	name := L.CheckString(2)
 	usage := L.CheckString(3)
-	cf := L.OptFunction(4, L.NewFunction(func(L *lua.LState) int {
-		L.Push(lua.LString(""))
-		return 1
-	}))
+	opts := optFlagOptions(L, 4, nil)
 
 	gf, ok := ud.Value.(*FlagSet)
 	if !ok {
 		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
 	}
 
-	var ints intslice
-	gf.fs.Var(&ints, name, usage)
-	gf.flags[name] = &flg{
-		name:   name,
-		value:  &ints,
-		usage:  usage,
-		compFn: cf,
+	var bools boolslice
+	gf.register(L, &flg{
+		name:  name,
+		value: &bools,
+		usage: usage,
+		split: opts.split,
+	}, opts)
+	if err := gf.setSliceDefault(name, opts.defaults, opts.appendDefaults); err != nil {
+		L.ArgError(4, err.Error())
 	}
 
 	return 0
 }
 
-func str(L *lua.LState) int {
+// count registers a flag counting the number of times it is given, e.g.
+// -v -v -v yields 3 more than the default value
+func count(L *lua.LState) int {
 	ud := L.CheckUserData(1)
 	name := L.CheckString(2)
-	value := L.CheckString(3)
+	value := L.CheckInt(3)
 	usage := L.CheckString(4)
-	cf := L.OptFunction(5, L.NewFunction(func(L *lua.LState) int {
-		L.Push(lua.LString(""))
-		return 1
-	}))
+	opts := optFlagOptions(L, 5, nil)
 
 	gf, ok := ud.Value.(*FlagSet)
 	if !ok {
 		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
 	}
 
-	f := gf.fs.String(name, value, usage)
-	gf.flags[name] = &flg{
-		name:   name,
-		value:  f,
-		usage:  usage,
-		compFn: cf,
-	}
+	c := counter(value)
+	gf.register(L, &flg{
+		name:  name,
+		value: &c,
+		usage: usage,
+	}, opts)
 
 	return 0
 }
 
-func strs(L *lua.LState) int {
+// choice registers a string flag that only accepts one of the given choices.
+// Unless a completion function is given the choices are used for completion.
+func choice(L *lua.LState) int {
 	ud := L.CheckUserData(1)
 	name := L.CheckString(2)
-	usage := L.CheckString(3)
-	cf := L.OptFunction(4, L.NewFunction(func(L *lua.LState) int {
-		L.Push(lua.LString(""))
+	value := L.CheckString(3)
+	choices := toStringSlice(L.CheckTable(4))
+	usage := L.CheckString(5)
+
+	if len(choices) == 0 {
+		L.ArgError(4, "expected at least one choice")
+	}
+
+	cv := &choiceValue{choices: choices}
+	if err := cv.Set(value); err != nil {
+		L.ArgError(3, err.Error())
+	}
+
+	opts := optFlagOptions(L, 6, L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LString(strings.Join(choices, " ")))
 		return 1
 	}))
 
@@ -470,36 +2954,60 @@ func strs(L *lua.LState) int {
 		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
 	}
 
-	var strs stringslice
-	gf.fs.Var(&strs, name, usage)
-	gf.flags[name] = &flg{
-		name:   name,
-		value:  &strs,
-		usage:  usage,
-		compFn: cf,
-	}
+	gf.register(L, &flg{
+		name:    name,
+		value:   cv,
+		usage:   usage,
+		choices: choices,
+	}, opts)
 
 	return 0
 }
 
-func boolean(L *lua.LState) int {
-	ud := L.CheckUserData(1)
+// custom registers a flag with a type implemented in Lua by the set and
+// string functions of the options table, the default is given as default
+func custom(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
 	name := L.CheckString(2)
-	value := L.CheckBool(3)
-	usage := L.CheckString(4)
+	usage := L.CheckString(3)
+	t := L.CheckTable(4)
+	opts := optFlagOptions(L, 4, noCompletions(L))
 
-	gf, ok := ud.Value.(*FlagSet)
+	set, ok := t.RawGetString("set").(*lua.LFunction)
 	if !ok {
-		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+		L.ArgError(4, "expected a set function")
 	}
-
-	f := gf.fs.Bool(name, value, usage)
-	gf.flags[name] = &flg{
-		name:   name,
-		value:  f,
-		usage:  usage,
-		compFn: nil,
+	cv := &customValue{L: L, set: set, def: t.RawGetString("default")}
+	if str, ok := t.RawGetString("string").(*lua.LFunction); ok {
+		cv.str = str
 	}
+	cv.value = cv.def
+
+	gf.register(L, &flg{
+		name:  name,
+		value: cv,
+		usage: usage,
+	}, opts)
+
+	return 0
+}
+
+// jsonFlag registers a flag taking a JSON text, which parse returns decoded
+// into lua values, objects and arrays as tables. The flag is nil when not given.
+func jsonFlag(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	name := L.CheckString(2)
+	usage := L.CheckString(3)
+	opts := optFlagOptions(L, 4, noCompletions(L))
+
+	jv := &jsonValue{}
+	gf.register(L, &flg{
+		name:     name,
+		value:    jv,
+		usage:    usage,
+		fromFile: opts.fromFile,
+		stdin:    opts.stdin,
+	}, opts)
 
 	return 0
 }
@@ -509,16 +3017,17 @@ func stringArgument(L *lua.LState) int {
 	name := L.CheckString(2)
 	times := L.CheckAny(3)
 	usage := L.CheckString(4)
-	cf := L.OptFunction(5, L.NewFunction(func(L *lua.LState) int {
-		L.Push(lua.LString(""))
-		return 1
-	}))
+	cf := L.OptFunction(5, noCompletions(L))
+
+	opts := optArgOptions(L, 6)
 
 	a := &argument{
-		name:   name,
-		usage:  usage,
-		compFn: cf,
-		typ:    "string",
+		name:    name,
+		usage:   usage,
+		compFn:  cf,
+		dynamic: L.Get(5) != lua.LNil,
+		typ:     "string",
+		def:     opts.def,
 	}
 
 	parser, err := getParser("string", times)
@@ -532,6 +3041,12 @@ func stringArgument(L *lua.LState) int {
 		L.RaiseError(err.Error())
 	}
 	a.shortUsage = su
+	a.nargs = rangeUsage(times)
+	a.slice = isSliceOption(times)
+
+	if err := a.checkDefault(); err != nil {
+		L.ArgError(6, err.Error())
+	}
 
 	gf, ok := ud.Value.(*FlagSet)
 	if !ok {
@@ -542,6 +3057,9 @@ func stringArgument(L *lua.LState) int {
 	udPossitionalArgument.Value = a
 	L.SetMetatable(ud, L.GetTypeMetatable(luaFlagSetTypeName))
 
+	if err := gf.checkArgumentName(a.name); err != nil {
+		L.RaiseError("%v", err)
+	}
 	gf.arguments = append(gf.arguments, a)
 
 	L.Push(udPossitionalArgument)
@@ -553,16 +3071,17 @@ func intArgument(L *lua.LState) int {
 	name := L.CheckString(2)
 	times := L.CheckAny(3)
 	usage := L.CheckString(4)
-	cf := L.OptFunction(5, L.NewFunction(func(L *lua.LState) int {
-		L.Push(lua.LString(""))
-		return 1
-	}))
+	cf := L.OptFunction(5, noCompletions(L))
+
+	opts := optArgOptions(L, 6)
 
 	a := &argument{
-		name:   name,
-		usage:  usage,
-		compFn: cf,
-		typ:    "int",
+		name:    name,
+		usage:   usage,
+		compFn:  cf,
+		dynamic: L.Get(5) != lua.LNil,
+		typ:     "int",
+		def:     opts.def,
 	}
 
 	parser, err := getParser("int", times)
@@ -576,6 +3095,12 @@ func intArgument(L *lua.LState) int {
 		L.RaiseError(err.Error())
 	}
 	a.shortUsage = su
+	a.nargs = rangeUsage(times)
+	a.slice = isSliceOption(times)
+
+	if err := a.checkDefault(); err != nil {
+		L.ArgError(6, err.Error())
+	}
 
 	gf, ok := ud.Value.(*FlagSet)
 	if !ok {
@@ -586,6 +3111,9 @@ func intArgument(L *lua.LState) int {
 	udPossitionalArgument.Value = a
 	L.SetMetatable(ud, L.GetTypeMetatable(luaFlagSetTypeName))
 
+	if err := gf.checkArgumentName(a.name); err != nil {
+		L.RaiseError("%v", err)
+	}
 	gf.arguments = append(gf.arguments, a)
 
 	L.Push(udPossitionalArgument)
@@ -597,16 +3125,17 @@ func numberArgument(L *lua.LState) int {
 	name := L.CheckString(2)
 	times := L.CheckAny(3)
 	usage := L.CheckString(4)
-	cf := L.OptFunction(5, L.NewFunction(func(L *lua.LState) int {
-		L.Push(lua.LString(""))
-		return 1
-	}))
+	cf := L.OptFunction(5, noCompletions(L))
+
+	opts := optArgOptions(L, 6)
 
 	a := &argument{
-		name:   name,
-		usage:  usage,
-		compFn: cf,
-		typ:    "number",
+		name:    name,
+		usage:   usage,
+		compFn:  cf,
+		dynamic: L.Get(5) != lua.LNil,
+		typ:     "number",
+		def:     opts.def,
 	}
 
 	parser, err := getParser("number", times)
@@ -620,6 +3149,52 @@ func numberArgument(L *lua.LState) int {
 		L.RaiseError(err.Error())
 	}
 	a.shortUsage = su
+	a.nargs = rangeUsage(times)
+	a.slice = isSliceOption(times)
+
+	if err := a.checkDefault(); err != nil {
+		L.ArgError(6, err.Error())
+	}
+
+	gf, ok := ud.Value.(*FlagSet)
+	if !ok {
+		L.RaiseError("Expected gluaflag userdata, got `%T`", ud.Value)
+	}
+
+	udPossitionalArgument := L.NewUserData()
+	udPossitionalArgument.Value = a
+	L.SetMetatable(ud, L.GetTypeMetatable(luaFlagSetTypeName))
+
+	if err := gf.checkArgumentName(a.name); err != nil {
+		L.RaiseError("%v", err)
+	}
+	gf.arguments = append(gf.arguments, a)
+
+	L.Push(udPossitionalArgument)
+	return 1
+}
+
+// restArgument defines an argument that takes all remaining positional
+// arguments as strings, also those looking like flags as flag parsing ends
+// at the first positional argument. A leading -- ends flag parsing before
+// the positional arguments, a later -- is kept as part of the rest.
+func restArgument(L *lua.LState) int {
+	ud := L.CheckUserData(1)
+	name := L.CheckString(2)
+	usage := L.CheckString(3)
+	cf := L.OptFunction(4, noCompletions(L))
+
+	a := &argument{
+		name:    name,
+		usage:   usage,
+		compFn:  cf,
+		dynamic: L.Get(4) != lua.LNil,
+		typ:     "string",
+		parser:  parseOptionalStrings,
+		slice:   true,
+		rest:    true,
+	}
+	a.shortUsage, _ = getShortUsageFn(lua.LString("*"))
 
 	gf, ok := ud.Value.(*FlagSet)
 	if !ok {
@@ -630,6 +3205,9 @@ func numberArgument(L *lua.LState) int {
 	udPossitionalArgument.Value = a
 	L.SetMetatable(ud, L.GetTypeMetatable(luaFlagSetTypeName))
 
+	if err := gf.checkArgumentName(a.name); err != nil {
+		L.RaiseError("%v", err)
+	}
 	gf.arguments = append(gf.arguments, a)
 
 	L.Push(udPossitionalArgument)
@@ -641,16 +3219,14 @@ func possitionalInt(L *lua.LState) int {
 	name := L.CheckString(2)
 	times := L.CheckAny(3)
 	usage := L.CheckString(4)
-	cf := L.OptFunction(5, L.NewFunction(func(L *lua.LState) int {
-		L.Push(lua.LString(""))
-		return 1
-	}))
+	cf := L.OptFunction(5, noCompletions(L))
 
 	a := &argument{
-		name:   name,
-		usage:  usage,
-		typ:    "int",
-		compFn: cf,
+		name:    name,
+		usage:   usage,
+		typ:     "int",
+		compFn:  cf,
+		dynamic: L.Get(5) != lua.LNil,
 	}
 
 	switch t := times.(type) {
@@ -685,13 +3261,164 @@ func possitionalInt(L *lua.LState) int {
 	udPossitionalArgument.Value = a
 	L.SetMetatable(ud, L.GetTypeMetatable(luaFlagSetTypeName))
 
+	if err := gf.checkArgumentName(a.name); err != nil {
+		L.RaiseError("%v", err)
+	}
 	gf.arguments = append(gf.arguments, a)
 
 	L.Push(udPossitionalArgument)
 	return 1
 }
 
-// Parse the command line parameters
+// ErrorKind classifies the errors returned when parsing
+type ErrorKind string
+
+// The kinds of parse errors
+const (
+	KindUnknownFlag      ErrorKind = "unknown_flag"
+	KindAmbiguousFlag    ErrorKind = "ambiguous_flag"
+	KindMissingValue     ErrorKind = "missing_value"
+	KindInvalidValue     ErrorKind = "invalid_value"
+	KindMissingRequired  ErrorKind = "missing_required"
+	KindExclusive        ErrorKind = "exclusive"
+	KindRequiredTogether ErrorKind = "required_together"
+	KindValidation       ErrorKind = "validation"
+	KindUnknownCommand   ErrorKind = "unknown_command"
+	KindArgument         ErrorKind = "argument"
+	KindUnknownArgument  ErrorKind = "unknown_argument"
+	KindResponseFile     ErrorKind = "response_file"
+	KindMultiple         ErrorKind = "multiple"
+	KindHelp             ErrorKind = "help"
+)
+
+// ParseError is the error returned by Parse, errors of the kind multiple
+// hold the collected errors in Errors. When -h or -help is given without
+// being defined the kind is help and Usage holds the usage to show. Flag is
+// the name of the flag the error is about, if any. Token is the argument that
+// caused the error, if known, and Position its 1-based index in the parsed
+// arguments, or 0 if it can not be determined.
+type ParseError struct {
+	Kind     ErrorKind
+	Err      error
+	Errors   []*ParseError
+	Usage    string
+	Flag     string
+	Token    string
+	Position int
+
+	// fs is the flag set whose usage is written when the error is raised
+	fs *FlagSet
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error, e.g. flag.ErrHelp
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// checkFlagWords returns the error the flag package reports for an unknown
+// flag or a flag missing its value in args, walking the flags as it does
+func (fs *FlagSet) checkFlagWords(args []string) *ParseError {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' || arg == "--" {
+			return nil
+		}
+
+		name := strings.TrimPrefix(arg[1:len(arg)], "-")
+		if name == "" || name[0] == '-' || name[0] == '=' {
+			return &ParseError{Kind: KindUnknownFlag, Err: fmt.Errorf("bad flag syntax: %s", arg), Token: arg}
+		}
+		token, hasValue := arg, false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, hasValue = name[:j], true
+			token = arg[:strings.Index(arg, "=")]
+		}
+
+		fl := fs.fs.Lookup(name)
+		switch {
+		case fl == nil && (name == "help" || name == "h"):
+			// reported as flag.ErrHelp by the flag package
+			return nil
+		case fl == nil:
+			return &ParseError{Kind: KindUnknownFlag, Err: fmt.Errorf("flag provided but not defined: -%s", name), Flag: name, Token: token}
+		case isBoolFlag(fl) || hasValue:
+		case i+1 < len(args):
+			i++
+		default:
+			return &ParseError{Kind: KindMissingValue, Err: fmt.Errorf("flag needs an argument: -%s", name), Flag: name, Token: token}
+		}
+	}
+	return nil
+}
+
+// setRecorder wraps the value of a flag while the flag package parses, to
+// record the flag and value of a failing Set
+type setRecorder struct {
+	flag.Value
+	name   string
+	failed *ParseError
+}
+
+func (r *setRecorder) unwrap() flag.Value {
+	return r.Value
+}
+
+// IsBoolFlag keeps boolean flags usable without a value
+func (r *setRecorder) IsBoolFlag() bool {
+	return isBoolValue(r.Value)
+}
+
+// Set implements the flag interface
+func (r *setRecorder) Set(value string) error {
+	err := r.Value.Set(value)
+	if err != nil {
+		r.failed.Flag, r.failed.Token = r.name, value
+	}
+	return err
+}
+
+// parseFlags parses the flags in args with the flag package, errors are
+// returned as *ParseError of the kind determined where they are found
+func (fs *FlagSet) parseFlags(args []string) error {
+	if perr := fs.checkFlagWords(args); perr != nil {
+		return perr
+	}
+
+	failed := &ParseError{Kind: KindInvalidValue}
+	fs.fs.VisitAll(func(fl *flag.Flag) {
+		fl.Value = &setRecorder{Value: fl.Value, name: fl.Name, failed: failed}
+	})
+	defer fs.fs.VisitAll(func(fl *flag.Flag) {
+		fl.Value = fl.Value.(*setRecorder).Value
+	})
+
+	err := fs.fs.Parse(args)
+	if err == nil || err == flag.ErrHelp {
+		return err
+	}
+	failed.Err = err
+	return failed
+}
+
+// SetReturnErrors makes parse in Lua return nil and an error table with the
+// kind and message of the error, instead of raising an error
+func (fs *FlagSet) SetReturnErrors(b bool) {
+	fs.returnErrors = b
+}
+
+func returnErrors(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
+	gf.SetReturnErrors(L.OptBool(2, true))
+	return 0
+}
+
+// Parse the command line parameters. Parse errors, including surplus
+// positional arguments, are returned as *ParseError and not raised in the
+// state, the parse method in Lua decides whether to raise them.
 func Parse(L *lua.LState, ud *lua.LUserData, args []string) (*lua.LTable, error) {
 	gf, ok := ud.Value.(*FlagSet)
 	if !ok {
@@ -699,71 +3426,309 @@ func Parse(L *lua.LState, ud *lua.LUserData, args []string) (*lua.LTable, error)
 		return nil, ErrUserDataType
 	}
 
-	gf.fs.SetOutput(ioutil.Discard)
-	gf.output = ioutil.Discard
-	err := gf.fs.Parse(args)
+	return gf.parse(L, args)
+}
+
+// ParseArgs creates a flag set named name, calls setup to let the caller
+// register its flags and parses args, which exclude the program name as
+// os.Args[1:] does. A nil setup parses against an empty flag set.
+func ParseArgs(L *lua.LState, name string, args []string, setup func(*FlagSet)) (*lua.LTable, error) {
+	ud := New(L, name)
+	if setup != nil {
+		setup(ud.Value.(*FlagSet))
+	}
+	return Parse(L, ud, args)
+}
+
+func (fs *FlagSet) parse(L *lua.LState, args []string) (*lua.LTable, error) {
+	given := args
+	if fs.responseFiles {
+		var err error
+		if args, err = expandResponseFiles(args, nil); err != nil {
+			return nil, &ParseError{Kind: KindResponseFile, Err: err}
+		}
+	}
+
+	// the passes below look up the flags by the name they were defined with
+	args, err := fs.canonicalArgs(args)
 	if err != nil {
-		return nil, err
+		return nil, &ParseError{Kind: KindAmbiguousFlag, Err: err}
+	}
+
+	args = fs.joinBoolValues(args)
+
+	if fs.interspersed {
+		args = fs.moveFlagsFirst(args)
+	}
+
+	args = fs.endFlagsAtNumber(args)
+
+	var unknown []string
+	if fs.ignoreUnknown {
+		args, unknown = fs.splitUnknown(args)
+	}
+
+	args = fs.applyOptionalValues(args)
+
+	// only count the occurrences of this parse, not setting defaults
+	fs.fs.VisitAll(func(fl *flag.Flag) {
+		if c := findCounter(fl.Value); c != nil {
+			c.n = 0
+		}
+	})
+
+	fs.fs.SetOutput(ioutil.Discard)
+	err = fs.parseFlags(args)
+	if err == flag.ErrHelp {
+		return nil, &ParseError{Kind: KindHelp, Err: err, Usage: fs.Usage()}
 	}
+	if perr, ok := err.(*ParseError); ok {
+		perr.fs = fs
+		perr.Position = tokenPosition(given, perr.Token)
+		return nil, perr
+	}
+
+	fs.visited = make(map[string]bool)
+	fs.fs.Visit(func(f *flag.Flag) {
+		fs.visited[fs.canonicalName(f.Name)] = true
+	})
+
+	fs.warnDeprecated()
 
 	t := L.NewTable()
-	for f, v := range gf.flags {
-		switch value := v.value.(type) {
-		case *float64:
-			t.RawSetString(f, lua.LNumber(*value))
-		case *string:
-			t.RawSetString(f, lua.LString(*value))
-		case *bool:
-			t.RawSetString(f, lua.LBool(*value))
-		case *int:
-			t.RawSetString(f, lua.LNumber(*value))
-		case *intslice:
-			t.RawSetString(f, value.Table(L))
-		case *numberslice:
-			t.RawSetString(f, value.Table(L))
-		case *stringslice:
-			t.RawSetString(f, value.Table(L))
-		default:
-			L.RaiseError("unknown type: `%T`", v)
+	if !fs.dryRun {
+		fs.fs.VisitAll(func(fl *flag.Flag) {
+			if _, ok := fs.aliases[fl.Name]; !ok {
+				t.RawSetString(fl.Name, fs.flagLValue(L, fl))
+			}
+		})
+	}
+
+	if err := fs.checkFlags(L, t); err != nil {
+		return nil, err
+	}
+
+	if fs.ignoreUnknown {
+		t.RawSetString("_unknown", toTable(L, unknown))
+	}
+
+	// dispatch to the subcommand named by the first positional argument
+	if len(fs.commands) > 0 && fs.fs.NArg() > 0 {
+		name := fs.fs.Arg(0)
+		cmd, ok := fs.commands[name]
+		if !ok {
+			perr := &ParseError{Kind: KindUnknownCommand, Err: fmt.Errorf("unknown command: %v", name), Token: name}
+			if offset := suffixOffset(given, fs.fs.Args()); offset >= 0 {
+				perr.Position = offset + 1
+			}
+			return nil, perr
+		}
+
+		sub, err := cmd.parse(L, fs.fs.Args()[1:])
+		if err != nil {
+			perr := &ParseError{Kind: KindInvalidValue, Err: fmt.Errorf("%v: %v", name, err)}
+			if sub, ok := err.(*ParseError); ok {
+				perr.Kind, perr.Errors, perr.Usage, perr.Token = sub.Kind, sub.Errors, sub.Usage, sub.Token
+				perr.Flag, perr.fs = sub.Flag, sub.fs
+				if offset := suffixOffset(given, fs.fs.Args()[1:]); offset >= 0 && sub.Position > 0 {
+					perr.Position = offset + sub.Position
+				}
+			}
+			return nil, perr
 		}
+		t.RawSetString("command", lua.LString(name))
+		t.RawSetString(name, sub)
+		return t, nil
 	}
 
 	// nothing defined for possitional arguments, just copy them
-	if len(gf.arguments) == 0 {
-		for _, v := range gf.fs.Args() {
+	if len(fs.arguments) == 0 {
+		for _, v := range fs.fs.Args() {
 			t.Append(lua.LString(v))
 		}
 		return t, nil
 	}
 
 	// TODO: refactor to a function in arguments
-	args = gf.fs.Args()
-	for _, arg := range gf.arguments {
+	args = fs.fs.Args()
+	for _, arg := range fs.arguments {
+		remaining := args
 		args, err = arg.parse(args, L)
 		if err != nil {
-			return nil, fmt.Errorf("argument %v: %v", arg.name, err.Error())
+			perr := &ParseError{Kind: KindArgument, Err: fmt.Errorf("argument %v: %v", arg.name, err.Error())}
+			if verr, ok := err.(*valueError); ok {
+				perr.Token = verr.value
+				if offset := suffixOffset(given, remaining); offset >= 0 {
+					perr.Position = offset + tokenPosition(remaining, verr.value)
+				}
+			}
+			return nil, perr
 		}
 		t.RawSetString(arg.name, arg.toLValue(L))
 	}
 
-	if len(args) > 0 {
-		L.RaiseError("unknown argument: %v", args)
+	if fs.collectRest {
+		t.RawSetString("rest", toTable(L, args))
+	} else if len(args) > 0 {
+		perr := &ParseError{Kind: KindUnknownArgument, Err: fmt.Errorf("unknown argument: %v", args), Token: args[0]}
+		if offset := suffixOffset(given, args); offset >= 0 {
+			perr.Position = offset + 1
+		}
+		return nil, perr
 	}
 
 	return t, nil
 }
 
-func parse(L *lua.LState) int {
-	ud := L.CheckUserData(1)
+// parseCollect parses with errors collected and returns the parse result and
+// an empty table, or nil and a list of error tables
+func parseCollect(L *lua.LState) int {
+	gf := checkFlagSet(L, 1)
 	args := L.CheckTable(2)
 
-	a := toStringSlice(args)
+	collect := gf.collectErrors
+	gf.collectErrors = true
+	defer func() { gf.collectErrors = collect }()
+
+	// the program name is not parsed
+	t, err := gf.parse(L, toArgs(args)[1:])
+	errs := L.NewTable()
+	if err == nil {
+		L.Push(t)
+		L.Push(errs)
+		return 2
+	}
+
+	if perr, ok := err.(*ParseError); ok && perr.Kind == KindMultiple {
+		for _, e := range perr.Errors {
+			errs.Append(errorTable(L, e))
+		}
+	} else {
+		errs.Append(errorTable(L, err))
+	}
+	L.Push(lua.LNil)
+	L.Push(errs)
+	return 2
+}
+
+func parse(L *lua.LState) int {
+	// the program name is not parsed
+	return parseTable(L, toArgs(L.CheckTable(2))[1:], false)
+}
+
+// parseArgs parses all elements of the table, without a program name
+func parseArgs(L *lua.LState) int {
+	return parseTable(L, toStringSlice(L.CheckTable(2)), false)
+}
+
+// parseStructured parses like parse but returns the flags, the named
+// positional arguments and the remaining positional arguments in separate
+// tables, {flags={...}, args={...}, positionals={...}}
+func parseStructured(L *lua.LState) int {
+	// the program name is not parsed
+	return parseTable(L, toArgs(L.CheckTable(2))[1:], true)
+}
+
+// parseTable parses args and pushes the result, or nil and the error table
+// for help requests and errors if returnErrors is set
+func parseTable(L *lua.LState, args []string, structured bool) int {
+	ud := L.CheckUserData(1)
 
-	t, err := Parse(L, ud, a[1:len(a)])
+	t, err := Parse(L, ud, args)
+	if perr, ok := err.(*ParseError); ok && perr.Kind == KindHelp {
+		// help is not an error, it is returned as {helpRequested=true, usage=}
+		L.Push(lua.LNil)
+		L.Push(errorTable(L, err))
+		return 2
+	}
 	if err != nil {
+		if gf := ud.Value.(*FlagSet); gf.returnErrors {
+			L.Push(lua.LNil)
+			L.Push(errorTable(L, err))
+			return 2
+		}
+		if perr, ok := err.(*ParseError); ok && perr.fs != nil {
+			perr.fs.writeErrorUsage()
+		}
 		L.RaiseError("%v", err)
 	}
 
+	if structured {
+		t = ud.Value.(*FlagSet).structure(L, t)
+	}
 	L.Push(t)
 	return 1
 }
+
+// structure splits a parse result into the flags, the named positional
+// arguments and the remaining positional arguments. The name of a subcommand
+// is kept under command and its structured result under subcommand.
+func (fs *FlagSet) structure(L *lua.LState, t *lua.LTable) *lua.LTable {
+	flags := L.NewTable()
+	fs.fs.VisitAll(func(fl *flag.Flag) {
+		if _, ok := fs.aliases[fl.Name]; !ok {
+			flags.RawSetString(fl.Name, t.RawGetString(fl.Name))
+		}
+	})
+
+	args := L.NewTable()
+	for _, a := range fs.arguments {
+		args.RawSetString(a.name, t.RawGetString(a.name))
+	}
+
+	positionals := L.NewTable()
+	for i := 1; i <= t.Len(); i++ {
+		positionals.Append(t.RawGetInt(i))
+	}
+	if rest, ok := t.RawGetString("rest").(*lua.LTable); ok && fs.collectRest {
+		for i := 1; i <= rest.Len(); i++ {
+			positionals.Append(rest.RawGetInt(i))
+		}
+	}
+
+	res := L.NewTable()
+	res.RawSetString("flags", flags)
+	res.RawSetString("args", args)
+	res.RawSetString("positionals", positionals)
+	if fs.ignoreUnknown {
+		res.RawSetString("unknown", t.RawGetString("_unknown"))
+	}
+	if name, ok := t.RawGetString("command").(lua.LString); ok && len(fs.commands) > 0 {
+		res.RawSetString("command", name)
+		if sub, ok := t.RawGetString(string(name)).(*lua.LTable); ok {
+			res.RawSetString("subcommand", fs.commands[string(name)].structure(L, sub))
+		}
+	}
+	return res
+}
+
+// errorTable converts a parse error to a table with the kind of the error
+// and its message
+func errorTable(L *lua.LState, err error) *lua.LTable {
+	t := L.NewTable()
+	if perr, ok := err.(*ParseError); ok {
+		t.RawSetString("kind", lua.LString(perr.Kind))
+		if perr.Flag != "" {
+			t.RawSetString("flag", lua.LString(perr.Flag))
+		}
+		if perr.Token != "" {
+			t.RawSetString("token", lua.LString(perr.Token))
+		}
+		if perr.Position > 0 {
+			t.RawSetString("position", lua.LNumber(perr.Position))
+		}
+		if perr.Kind == KindHelp {
+			t.RawSetString("helpRequested", lua.LTrue)
+			t.RawSetString("usage", lua.LString(perr.Usage))
+		}
+		if len(perr.Errors) > 0 {
+			errs := L.NewTable()
+			for _, e := range perr.Errors {
+				errs.Append(errorTable(L, e))
+			}
+			t.RawSetString("errors", errs)
+		}
+	}
+	t.RawSetString("message", lua.LString(err.Error()))
+	return t
+}
@@ -1,13 +1,20 @@
 package gluaflag
 
-import "github.com/yuin/gopher-lua"
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/yuin/gopher-lua"
+)
+
+// toStringSlice converts the values at positive integer keys of the table
 func toStringSlice(t *lua.LTable) []string {
 	args := make([]string, 0, t.Len())
-	if zv := t.RawGet(lua.LNumber(0)); zv.Type() != lua.LTNil {
-		args = append(args, zv.String())
-	}
-
 	t.ForEach(func(k, v lua.LValue) {
 		if key, ok := k.(lua.LNumber); !ok || int(key) < 1 {
 			return
@@ -17,6 +24,20 @@ func toStringSlice(t *lua.LTable) []string {
 	return args
 }
 
+// toArgs converts an arg style table to a slice that starts with the program
+// name. The program name is at index 0, as in the arg table of the lua
+// interpreter, or if index 0 is not set, the first element of the table.
+func toArgs(t *lua.LTable) []string {
+	args := toStringSlice(t)
+	if name := t.RawGet(lua.LNumber(0)); name != lua.LNil {
+		return append([]string{name.String()}, args...)
+	}
+	if len(args) == 0 {
+		return []string{""}
+	}
+	return args
+}
+
 func toTable(L *lua.LState, s []string) *lua.LTable {
 	table := L.NewTable()
 	for _, str := range s {
@@ -60,3 +81,284 @@ func checkFlagSet(L *lua.LState, i int) *FlagSet {
 	L.RaiseError("expected flagset userdata, got: `%T`", ud.Value)
 	return nil
 }
+
+// toDuration converts a duration string, e.g. "2m30s", or a number of seconds
+// to a time.Duration
+func toDuration(L *lua.LState, v lua.LValue) time.Duration {
+	switch t := v.(type) {
+	case lua.LNumber:
+		return time.Duration(float64(t) * float64(time.Second))
+	case lua.LString:
+		d, err := time.ParseDuration(string(t))
+		if err != nil {
+			L.RaiseError("invalid duration value: %v", string(t))
+		}
+		return d
+	}
+
+	L.RaiseError("expected duration string or number of seconds, got: `%v`", v.Type())
+	return 0
+}
+
+// maxExactInt is the largest integer a lua number (float64) can represent exactly
+const maxExactInt = 1 << 53
+
+// int64ToLValue returns v as a lua number, or as a string if the value would
+// lose precision as a float64
+func int64ToLValue(v int64) lua.LValue {
+	if v > maxExactInt || v < -maxExactInt {
+		return lua.LString(strconv.FormatInt(v, 10))
+	}
+	return lua.LNumber(v)
+}
+
+// uint64ToLValue returns v as a lua number, or as a string if the value would
+// lose precision as a float64
+func uint64ToLValue(v uint64) lua.LValue {
+	if v > maxExactInt {
+		return lua.LString(strconv.FormatUint(v, 10))
+	}
+	return lua.LNumber(v)
+}
+
+// isZeroValue reports whether the default value of the flag is the zero value
+// of its type, mirroring the unexported helper in the flag package
+func isZeroValue(fl *flag.Flag) bool {
+	value := unwrapValue(fl.Value)
+
+	typ := reflect.TypeOf(value)
+	var z reflect.Value
+	if typ.Kind() == reflect.Ptr {
+		z = reflect.New(typ.Elem())
+	} else {
+		z = reflect.Zero(typ)
+	}
+	return fl.DefValue == z.Interface().(flag.Value).String()
+}
+
+func isString(v interface{}) bool {
+	_, ok := v.(string)
+	return ok
+}
+
+// reraise raises an error returned from a protected call as a lua error,
+// keeping the original error object when possible
+func reraise(L *lua.LState, err error) {
+	if apiErr, ok := err.(*lua.ApiError); ok {
+		L.Error(apiErr.Object, 0)
+	}
+	L.RaiseError("%v", err)
+}
+
+// isFlag reports whether the command line word looks like a flag, empty words
+// are not flags
+func isFlag(word string) bool {
+	return len(word) > 0 && word[0] == '-'
+}
+
+// tokenPosition returns the 1-based index of token in args, or 0 if it is not
+// there or not unique
+func tokenPosition(args []string, token string) int {
+	position := 0
+	for i, arg := range args {
+		if arg != token {
+			continue
+		}
+		if position > 0 {
+			return 0
+		}
+		position = i + 1
+	}
+	return position
+}
+
+// suffixOffset returns the number of args before rest if rest is the end of
+// args, or -1 if it is not
+func suffixOffset(args, rest []string) int {
+	offset := len(args) - len(rest)
+	if offset < 0 {
+		return -1
+	}
+	for i, arg := range rest {
+		if args[offset+i] != arg {
+			return -1
+		}
+	}
+	return offset
+}
+
+// resetValue sets the value of the flag back to its default
+func resetValue(fl *flag.Flag) error {
+	for v := fl.Value; ; {
+		if r, ok := v.(resetter); ok {
+			return r.reset(fl.DefValue)
+		}
+		w, ok := v.(interface {
+			unwrap() flag.Value
+		})
+		if !ok {
+			return v.Set(fl.DefValue)
+		}
+		v = w.unwrap()
+	}
+}
+
+// checkBounds returns an error if v is outside of the optional min and max
+func checkBounds(name string, v float64, min, max *float64) error {
+	if min != nil && v < *min {
+		return fmt.Errorf("%v: %v is below min %v", name, formatFloat(v), formatFloat(*min))
+	}
+	if max != nil && v > *max {
+		return fmt.Errorf("%v: %v exceeds max %v", name, formatFloat(v), formatFloat(*max))
+	}
+	return nil
+}
+
+// formatFloat formats a bound or value without an exponent
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// trimLineEnding removes one trailing "\n" or "\r\n" from s
+func trimLineEnding(s string) string {
+	if strings.HasSuffix(s, "\r\n") {
+		return s[:len(s)-2]
+	}
+	return strings.TrimSuffix(s, "\n")
+}
+
+// copyGoValue returns a copy of a value defined on the Go flag set, set to
+// its default def. The copy is shallow, values referring to other data, e.g.
+// flag.TextVar, still share it.
+func copyGoValue(v flag.Value, def string) flag.Value {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return v
+	}
+	c := reflect.New(rv.Elem().Type())
+	c.Elem().Set(rv.Elem())
+	value, ok := c.Interface().(flag.Value)
+	if !ok {
+		return v
+	}
+	value.Set(def)
+	return value
+}
+
+// toFloat converts the numeric value of a flag to a float64
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(float32ToLNumber(n)), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// unwrapValue returns the underlying value of validating flag values
+func unwrapValue(v flag.Value) flag.Value {
+	for {
+		w, ok := v.(interface {
+			unwrap() flag.Value
+		})
+		if !ok {
+			return v
+		}
+		v = w.unwrap()
+	}
+}
+
+// findCounter returns the wrapper counting the occurrences of a slice flag,
+// or nil if the value is not counted
+func findCounter(v flag.Value) *countingValue {
+	for {
+		if c, ok := v.(*countingValue); ok {
+			return c
+		}
+		w, ok := v.(interface {
+			unwrap() flag.Value
+		})
+		if !ok {
+			return nil
+		}
+		v = w.unwrap()
+	}
+}
+
+func patternError(name, value string, pattern *regexp.Regexp) error {
+	return fmt.Errorf("%v: %q does not match pattern %q", name, value, pattern.String())
+}
+
+// isBoolFlag reports whether the flag can be given without a value
+func isBoolFlag(fl *flag.Flag) bool {
+	return isBoolValue(fl.Value)
+}
+
+// isBoolValue reports whether the value is boolean, asking the outermost
+// wrapper of the value that knows
+func isBoolValue(v flag.Value) bool {
+	for {
+		if b, ok := v.(interface {
+			IsBoolFlag() bool
+		}); ok {
+			return b.IsBoolFlag()
+		}
+		w, ok := v.(interface {
+			unwrap() flag.Value
+		})
+		if !ok {
+			return false
+		}
+		v = w.unwrap()
+	}
+}
+
+// float32ToLNumber converts v to a lua number using the shortest decimal
+// representation of the float32, so 0.1 is reported as 0.1
+func float32ToLNumber(v float32) lua.LNumber {
+	f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(v), 'g', -1, 32), 64)
+	return lua.LNumber(f)
+}
+
+// usageIndent is the width of the indentation of usage text, four spaces and
+// a tab
+const usageIndent = 8
+
+// wrapText word wraps each line of s at width, words longer than the width
+// are kept whole. A width less than one disables wrapping.
+func wrapText(s string, width int) string {
+	if width < 1 {
+		return s
+	}
+
+	lines := strings.Split(s, "\n")
+	for i, line := range lines {
+		words := strings.Fields(line)
+		if len(words) == 0 {
+			continue
+		}
+
+		wrapped := words[0]
+		n := len(words[0])
+		for _, word := range words[1:len(words)] {
+			if n+1+len(word) > width {
+				wrapped += "\n" + word
+				n = len(word)
+				continue
+			}
+			wrapped += " " + word
+			n += 1 + len(word)
+		}
+		lines[i] = wrapped
+	}
+	return strings.Join(lines, "\n")
+}
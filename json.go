@@ -0,0 +1,148 @@
+package gluaflag
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// ToJSON serializes a table returned from Parse. Slices become arrays and the
+// positional arguments in the array part of the table are stored as "_args".
+func ToJSON(t *lua.LTable) (string, error) {
+	b, err := json.Marshal(toJSONValue(t))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func toJSONValue(v lua.LValue) interface{} {
+	switch value := v.(type) {
+	case lua.LBool:
+		return bool(value)
+	case lua.LNumber:
+		return float64(value)
+	case lua.LString:
+		return string(value)
+	case *lua.LTable:
+		return tableToJSONValue(value)
+	}
+	return nil
+}
+
+func tableToJSONValue(t *lua.LTable) interface{} {
+	array := make([]interface{}, 0, t.Len())
+	for i := 1; i <= t.Len(); i++ {
+		array = append(array, toJSONValue(t.RawGetInt(i)))
+	}
+
+	object := make(map[string]interface{})
+	t.ForEach(func(k, v lua.LValue) {
+		if n, ok := k.(lua.LNumber); ok && float64(n) == float64(int(n)) && int(n) >= 1 && int(n) <= t.Len() {
+			return
+		}
+		object[k.String()] = toJSONValue(v)
+	})
+
+	if len(object) == 0 {
+		return array
+	}
+	if len(array) > 0 {
+		object["_args"] = array
+	}
+	return object
+}
+
+// jsonValue holds the raw JSON text given for a json flag, it is decoded into
+// lua values by parse
+type jsonValue struct {
+	raw string
+}
+
+// String implements the stringer interface
+func (j *jsonValue) String() string {
+	if j == nil {
+		return ""
+	}
+	return j.raw
+}
+
+// Set implements the flag interface
+func (j *jsonValue) Set(value string) error {
+	var v interface{}
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	j.raw = value
+	return nil
+}
+
+func (j *jsonValue) reset(def string) error {
+	j.raw = def
+	return nil
+}
+
+// LValue decodes the JSON text, nil is returned when no value is set
+func (j *jsonValue) LValue(L *lua.LState) lua.LValue {
+	if j.raw == "" {
+		return lua.LNil
+	}
+	var v interface{}
+	d := json.NewDecoder(strings.NewReader(j.raw))
+	d.UseNumber()
+	if d.Decode(&v) != nil {
+		return lua.LNil
+	}
+	return fromJSONValue(L, v)
+}
+
+// fromJSONValue converts a value decoded by encoding/json into a lua value,
+// objects and arrays become tables, with null elements left as holes in
+// arrays. Integers that can not be represented exactly as a lua number are
+// returned as strings, like the values of int64 flags.
+func fromJSONValue(L *lua.LState, v interface{}) lua.LValue {
+	switch value := v.(type) {
+	case bool:
+		return lua.LBool(value)
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return int64ToLValue(i)
+		}
+		if u, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			return uint64ToLValue(u)
+		}
+		f, _ := value.Float64()
+		return lua.LNumber(f)
+	case string:
+		return lua.LString(value)
+	case []interface{}:
+		t := L.CreateTable(len(value), 0)
+		for i, e := range value {
+			t.RawSetInt(i+1, fromJSONValue(L, e))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.CreateTable(0, len(value))
+		for k, e := range value {
+			t.RawSetString(k, fromJSONValue(L, e))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+func toJSON(L *lua.LState) int {
+	checkFlagSet(L, 1)
+	t := L.CheckTable(2)
+
+	s, err := ToJSON(t)
+	if err != nil {
+		L.RaiseError("%v", err)
+	}
+
+	L.Push(lua.LString(s))
+	return 1
+}
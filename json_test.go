@@ -0,0 +1,76 @@
+package gluaflag
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestToJSON(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	arg = {"-name", "foo", "-times", "2", "-times", "3", "-q", "bar", "baz"}
+	arg[0] = "subcmd"
+	fs = flag.new()
+	fs:string("name", "", "String help string")
+	fs:ints("times", "Ints help string")
+	fs:strings("tags", "Strings help string")
+	fs:bool("q", false, "Bool help string")
+	fs:number("ratio", 0.5, "Number help string")
+	flags = fs:parse(arg)
+
+	print(fs:toJSON(flags))
+	`
+
+	expected := `{"_args":["bar","baz"],"name":"foo","q":true,"ratio":0.5,"tags":[],"times":[2,3]}`
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
+
+func TestJSONFlag(t *testing.T) {
+	src := `
+	local flag = require('flag')
+	fs = flag.new()
+	fs:json("filter", "Filter")
+	fs:json("limit", "Limit")
+	fs:json("ids", "Ids")
+	fs:json("none", "None")
+	fs:returnErrors()
+
+	flags = fs:parseArgs({
+		"-filter", '{"name": "foo", "tags": ["a", "b"], "owner": {"id": 7, "active": true}}',
+		"-limit", "10",
+		"-ids", '[1, [2, 3]]',
+	})
+	print(flags.filter.name, flags.filter.tags[1], flags.filter.tags[2], flags.filter.owner.id, flags.filter.owner.active)
+	print(flags.limit, type(flags.limit))
+	print(#flags.ids, flags.ids[1], flags.ids[2][1], flags.ids[2][2])
+	print(flags.none)
+
+	fs:reset()
+	flags = fs:parseArgs({"-ids", '[1, null, 3]', "-filter", '{"a": null, "b": 12345678901234567890, "c": 1.5}'})
+	print(flags.ids[1], flags.ids[2], flags.ids[3])
+	print(flags.filter.a, flags.filter.b, type(flags.filter.b), flags.filter.c)
+
+	fs:reset()
+	local _, err = fs:parseArgs({"-filter", '{"name":'})
+	print(err.message)
+	`
+
+	expected := strings.Join([]string{
+		"foo\ta\tb\t7\ttrue",
+		"10\tnumber",
+		"2\t1\t2\t3",
+		"nil",
+		"1\tnil\t3",
+		"nil\t12345678901234567890\tstring\t1.5",
+		`invalid value "{\"name\":" for flag -filter: invalid JSON: unexpected end of JSON input`,
+	}, "\n")
+	got, _ := doString(src, t)
+
+	if got != expected {
+		t.Errorf("expected: `%v`, got: `%v`\nsrc: `%v`", expected, got, src)
+	}
+}
@@ -15,7 +15,11 @@ const (
 var ErrUserDataType = fmt.Errorf("Expected gluaflag userdata")
 
 var exports = map[string]lua.LGFunction{
-	"new": new,
+	"new":         new,
+	"parseSimple": parseSimple,
+	"files":       files,
+	"dirs":        dirs,
+	"envNames":    envNames,
 }
 
 // Loader is used for preloading the module
@@ -1,12 +1,25 @@
 package gluaflag
 
 import (
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/yuin/gopher-lua"
 )
 
+// resetter is implemented by values that can not be reset to their default
+// by setting the flag default value again
+type resetter interface {
+	reset(def string) error
+}
+
 type numberslice []float64
 
 // String implements the stringer interface
@@ -24,6 +37,11 @@ func (i *numberslice) Set(value string) error {
 	return nil
 }
 
+func (i *numberslice) reset(def string) error {
+	*i = nil
+	return nil
+}
+
 // Table converts the slice to a lua.LTable
 func (i *numberslice) Table(L *lua.LState) *lua.LTable {
 	t := L.NewTable()
@@ -33,6 +51,62 @@ func (i *numberslice) Table(L *lua.LState) *lua.LTable {
 	return t
 }
 
+type float32Value float32
+
+// String implements the stringer interface
+func (f *float32Value) String() string {
+	if f == nil {
+		return "0"
+	}
+	return strconv.FormatFloat(float64(*f), 'g', -1, 32)
+}
+
+// Set implements the flag interface
+func (f *float32Value) Set(value string) error {
+	tmp, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		return err
+	}
+	*f = float32Value(tmp)
+	return nil
+}
+
+// Get implements the flag.Getter interface
+func (f *float32Value) Get() interface{} {
+	return float32(*f)
+}
+
+type float32slice []float32
+
+// String implements the stringer interface
+func (f *float32slice) String() string {
+	return fmt.Sprintf("%v", *f)
+}
+
+// Set implements the flag interface
+func (f *float32slice) Set(value string) error {
+	tmp, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, float32(tmp))
+	return nil
+}
+
+func (f *float32slice) reset(def string) error {
+	*f = nil
+	return nil
+}
+
+// Table converts the slice to a lua.LTable
+func (f *float32slice) Table(L *lua.LState) *lua.LTable {
+	t := L.NewTable()
+	for _, v := range *f {
+		t.Append(float32ToLNumber(v))
+	}
+	return t
+}
+
 type intslice []int
 
 // String implements the stringer interface
@@ -50,6 +124,11 @@ func (i *intslice) Set(value string) error {
 	return nil
 }
 
+func (i *intslice) reset(def string) error {
+	*i = nil
+	return nil
+}
+
 func (i *intslice) Table(L *lua.LState) *lua.LTable {
 	t := L.NewTable()
 	for _, v := range *i {
@@ -58,6 +137,85 @@ func (i *intslice) Table(L *lua.LState) *lua.LTable {
 	return t
 }
 
+// portValue is a network port between 1 and 65535, with anyPort set 0 is
+// accepted as well to mean any port
+type portValue struct {
+	port    int
+	anyPort bool
+}
+
+// String implements the stringer interface
+func (p *portValue) String() string {
+	if p == nil {
+		return "0"
+	}
+	return strconv.Itoa(p.port)
+}
+
+// Set implements the flag interface
+func (p *portValue) Set(value string) error {
+	port, err := parsePort(value, p.anyPort)
+	if err != nil {
+		return err
+	}
+	p.port = port
+	return nil
+}
+
+// Get implements the flag.Getter interface
+func (p *portValue) Get() interface{} {
+	return p.port
+}
+
+type portslice struct {
+	ports   []int
+	anyPort bool
+}
+
+// String implements the stringer interface
+func (p *portslice) String() string {
+	if p == nil {
+		return "[]"
+	}
+	return fmt.Sprintf("%d", p.ports)
+}
+
+// Set implements the flag interface
+func (p *portslice) Set(value string) error {
+	port, err := parsePort(value, p.anyPort)
+	if err != nil {
+		return err
+	}
+	p.ports = append(p.ports, port)
+	return nil
+}
+
+func (p *portslice) reset(def string) error {
+	p.ports = nil
+	return nil
+}
+
+func (p *portslice) Table(L *lua.LState) *lua.LTable {
+	t := L.NewTable()
+	for _, v := range p.ports {
+		t.Append(lua.LNumber(v))
+	}
+	return t
+}
+
+// parsePort parses a port between 1 and 65535, or 0 as well if anyPort is set
+func parsePort(value string, anyPort bool) (int, error) {
+	low := 1
+	if anyPort {
+		low = 0
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port < low || port > 65535 {
+		return 0, fmt.Errorf("expected port between %d and 65535", low)
+	}
+	return port, nil
+}
+
 type stringslice []string
 
 // String implements the stringer interface
@@ -71,6 +229,11 @@ func (s *stringslice) Set(value string) error {
 	return nil
 }
 
+func (s *stringslice) reset(def string) error {
+	*s = nil
+	return nil
+}
+
 func (s *stringslice) Table(L *lua.LState) *lua.LTable {
 	t := L.NewTable()
 	for _, v := range *s {
@@ -78,3 +241,533 @@ func (s *stringslice) Table(L *lua.LState) *lua.LTable {
 	}
 	return t
 }
+
+type boolslice []bool
+
+// String implements the stringer interface
+func (b *boolslice) String() string {
+	return fmt.Sprintf("%v", *b)
+}
+
+// Set implements the flag interface
+func (b *boolslice) Set(value string) error {
+	tmp, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*b = append(*b, tmp)
+	return nil
+}
+
+// IsBoolFlag allows the flag to be given without a value
+func (b *boolslice) IsBoolFlag() bool {
+	return true
+}
+
+func (b *boolslice) reset(def string) error {
+	*b = nil
+	return nil
+}
+
+func (b *boolslice) Table(L *lua.LState) *lua.LTable {
+	t := L.NewTable()
+	for _, v := range *b {
+		t.Append(lua.LBool(v))
+	}
+	return t
+}
+
+type durationslice []time.Duration
+
+// String implements the stringer interface
+func (d *durationslice) String() string {
+	return fmt.Sprintf("%v", *d)
+}
+
+// Set implements the flag interface
+func (d *durationslice) Set(value string) error {
+	tmp, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = append(*d, tmp)
+	return nil
+}
+
+func (d *durationslice) reset(def string) error {
+	*d = nil
+	return nil
+}
+
+// Table converts the slice to a lua.LTable of nanoseconds
+func (d *durationslice) Table(L *lua.LState) *lua.LTable {
+	t := L.NewTable()
+	for _, v := range *d {
+		t.Append(lua.LNumber(v))
+	}
+	return t
+}
+
+// keyvalues collects key=value pairs, later values overwrite earlier values
+// for the same key
+type keyvalues map[string]string
+
+// String implements the stringer interface
+func (kv *keyvalues) String() string {
+	if kv == nil || *kv == nil {
+		return "[]"
+	}
+	pairs := make([]string, 0, len(*kv))
+	for k, v := range *kv {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return fmt.Sprintf("%v", pairs)
+}
+
+// Set implements the flag interface
+func (kv *keyvalues) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 0 {
+		return fmt.Errorf("expected key=value, got: %v", value)
+	}
+	if *kv == nil {
+		*kv = make(keyvalues)
+	}
+	(*kv)[value[:i]] = value[i+1:]
+	return nil
+}
+
+func (kv *keyvalues) reset(def string) error {
+	*kv = nil
+	return nil
+}
+
+func (kv *keyvalues) Table(L *lua.LState) *lua.LTable {
+	t := L.NewTable()
+	for k, v := range *kv {
+		t.RawSetString(k, lua.LString(v))
+	}
+	return t
+}
+
+type counter int
+
+// String implements the stringer interface
+func (c *counter) String() string {
+	if c == nil {
+		return "0"
+	}
+	return strconv.Itoa(int(*c))
+}
+
+// Set implements the flag interface, each occurrence increments the counter
+// while an explicit false value resets it
+func (c *counter) Set(value string) error {
+	tmp, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	if !tmp {
+		*c = 0
+		return nil
+	}
+	*c++
+	return nil
+}
+
+// IsBoolFlag allows the flag to be given without a value
+func (c *counter) IsBoolFlag() bool {
+	return true
+}
+
+func (c *counter) reset(def string) error {
+	tmp, err := strconv.Atoi(def)
+	if err != nil {
+		return err
+	}
+	*c = counter(tmp)
+	return nil
+}
+
+type choiceValue struct {
+	value   string
+	choices []string
+}
+
+// String implements the stringer interface
+func (c *choiceValue) String() string {
+	if c == nil {
+		return ""
+	}
+	return c.value
+}
+
+// Set implements the flag interface
+func (c *choiceValue) Set(value string) error {
+	for _, choice := range c.choices {
+		if value == choice {
+			c.value = value
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid choice %q, valid choices are: %v", value, strings.Join(c.choices, ", "))
+}
+
+// luaWriter is an io.Writer calling a lua function with each written string
+type luaWriter struct {
+	L  *lua.LState
+	fn *lua.LFunction
+}
+
+// Write implements the io.Writer interface
+func (w *luaWriter) Write(p []byte) (int, error) {
+	if err := w.L.CallByParam(lua.P{
+		Fn:      w.fn,
+		NRet:    0,
+		Protect: true,
+	}, lua.LString(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// customValue is a flag value implemented by Lua callbacks. set is called
+// with the command line value and the current value and returns the new
+// value, or nil and an error message. string converts the value for the usage.
+type customValue struct {
+	L     *lua.LState
+	set   *lua.LFunction
+	str   *lua.LFunction
+	def   lua.LValue
+	value lua.LValue
+
+	// dryRun accepts any value without calling set, see Validate
+	dryRun bool
+}
+
+// String implements the stringer interface
+func (c *customValue) String() string {
+	if c.L == nil || c.value == lua.LNil {
+		return ""
+	}
+	if c.str == nil {
+		return c.value.String()
+	}
+
+	if err := c.L.CallByParam(lua.P{Fn: c.str, NRet: 1, Protect: true}, c.value); err != nil {
+		return ""
+	}
+	ret := c.L.Get(-1)
+	c.L.Pop(1)
+	return ret.String()
+}
+
+// Set implements the flag interface
+func (c *customValue) Set(value string) error {
+	if c.dryRun {
+		return nil
+	}
+	if err := c.L.CallByParam(lua.P{Fn: c.set, NRet: 2, Protect: true}, lua.LString(value), c.value); err != nil {
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			return fmt.Errorf("%v", apiErr.Object)
+		}
+		return err
+	}
+	ret, msg := c.L.Get(-2), c.L.Get(-1)
+	c.L.Pop(2)
+
+	if s, ok := msg.(lua.LString); ok {
+		return fmt.Errorf("%v", s)
+	}
+	c.value = ret
+	return nil
+}
+
+func (c *customValue) reset(def string) error {
+	c.value = c.def
+	return nil
+}
+
+// sliceDefault wraps a slice flag value holding a default list, which is
+// replaced by the values from the command line, or with appendDefaults set
+// kept and appended to
+type sliceDefault struct {
+	flag.Value
+	defaults       []string
+	appendDefaults bool
+	replaced       bool
+}
+
+func (s *sliceDefault) unwrap() flag.Value {
+	return s.Value
+}
+
+// IsBoolFlag keeps slices of booleans with a default usable without a value
+func (s *sliceDefault) IsBoolFlag() bool {
+	return isBoolValue(s.Value)
+}
+
+// Set implements the flag interface
+func (s *sliceDefault) Set(value string) error {
+	if !s.replaced {
+		s.replaced = true
+		if !s.appendDefaults {
+			unwrapValue(s.Value).(resetter).reset("")
+		}
+	}
+	return s.Value.Set(value)
+}
+
+func (s *sliceDefault) reset(def string) error {
+	unwrapValue(s.Value).(resetter).reset("")
+	for _, d := range s.defaults {
+		if err := s.Value.Set(d); err != nil {
+			return err
+		}
+	}
+	s.replaced = false
+	return nil
+}
+
+// unitValue wraps a numeric flag value and accepts underscores between digits
+// and a unit suffix. With a base of 1024 the suffixes k, M and G multiply by
+// 1024, 1024^2 and 1024^3, with a base of 1000 by 1000, 1000^2 and 1000^3.
+type unitValue struct {
+	flag.Value
+	base float64
+}
+
+func (u *unitValue) unwrap() flag.Value {
+	return u.Value
+}
+
+// Set implements the flag interface
+func (u *unitValue) Set(value string) error {
+	s := strings.Replace(value, "_", "", -1)
+
+	multiplier := 1.0
+	if i := strings.LastIndexAny(s, "0123456789."); i >= 0 && i < len(s)-1 {
+		switch suffix := s[i+1:]; suffix {
+		case "k", "K":
+			multiplier = u.base
+		case "M":
+			multiplier = u.base * u.base
+		case "G":
+			multiplier = u.base * u.base * u.base
+		default:
+			return fmt.Errorf("unknown unit suffix %q", suffix)
+		}
+		s = s[:i+1]
+	}
+
+	if multiplier == 1 {
+		return u.Value.Set(s)
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	return u.Value.Set(strconv.FormatFloat(v*multiplier, 'f', -1, 64))
+}
+
+// fileValue wraps a flag value and sets it to the contents of the file named
+// by values starting with @, without one trailing line ending. @@ sets a value
+// starting with @. With response files enabled the value must be given as
+// -flag=@name to not be expanded as a response file.
+type fileValue struct {
+	flag.Value
+	dryRun bool
+}
+
+func (f *fileValue) unwrap() flag.Value {
+	return f.Value
+}
+
+// Set implements the flag interface
+func (f *fileValue) Set(value string) error {
+	if !strings.HasPrefix(value, "@") {
+		return f.Value.Set(value)
+	}
+	if strings.HasPrefix(value, "@@") {
+		return f.Value.Set(value[1:len(value)])
+	}
+
+	if f.dryRun {
+		return nil
+	}
+
+	b, err := ioutil.ReadFile(value[1:len(value)])
+	if err != nil {
+		return fmt.Errorf("reading value: %v", err)
+	}
+	return f.Value.Set(trimLineEnding(string(b)))
+}
+
+// stdinValue wraps a flag value and sets it to all of stdin for the value -.
+// Reading blocks until stdin is closed.
+type stdinValue struct {
+	flag.Value
+	dryRun bool
+}
+
+func (s *stdinValue) unwrap() flag.Value {
+	return s.Value
+}
+
+// Set implements the flag interface
+func (s *stdinValue) Set(value string) error {
+	if value != "-" {
+		return s.Value.Set(value)
+	}
+	if s.dryRun {
+		return nil
+	}
+
+	b, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("reading stdin: %v", err)
+	}
+	return s.Value.Set(string(b))
+}
+
+// optionalValue wraps the value of a flag whose value is optional. It reports
+// itself as boolean flag, so the flag never takes the following argument,
+// parse gives the flag its present value when given without one.
+type optionalValue struct {
+	flag.Value
+	present string
+}
+
+func (o *optionalValue) unwrap() flag.Value {
+	return o.Value
+}
+
+// IsBoolFlag allows the flag to be given without a value
+func (o *optionalValue) IsBoolFlag() bool {
+	return true
+}
+
+// countingValue wraps a slice flag value and counts the calls to Set
+type countingValue struct {
+	flag.Value
+	n int
+}
+
+func (c *countingValue) unwrap() flag.Value {
+	return c.Value
+}
+
+// Set implements the flag interface
+func (c *countingValue) Set(value string) error {
+	c.n++
+	return c.Value.Set(value)
+}
+
+// IsBoolFlag keeps slices of booleans usable without a value
+func (c *countingValue) IsBoolFlag() bool {
+	return isBoolValue(c.Value)
+}
+
+// baseValue wraps an integer flag value and parses values in the given base,
+// a base of 0 is derived from the prefix of the value
+type baseValue struct {
+	flag.Value
+	base     int
+	unsigned bool
+}
+
+func (b *baseValue) unwrap() flag.Value {
+	return b.Value
+}
+
+// Set implements the flag interface
+func (b *baseValue) Set(value string) error {
+	if b.unsigned {
+		v, err := strconv.ParseUint(value, b.base, 64)
+		if err != nil {
+			return err
+		}
+		return b.Value.Set(strconv.FormatUint(v, 10))
+	}
+
+	v, err := strconv.ParseInt(value, b.base, 64)
+	if err != nil {
+		return err
+	}
+	return b.Value.Set(strconv.FormatInt(v, 10))
+}
+
+// boundedValue wraps a numeric flag value and validates it against optional
+// min and max bounds
+type boundedValue struct {
+	flag.Value
+	name string
+	min  *float64
+	max  *float64
+}
+
+func (b *boundedValue) unwrap() flag.Value {
+	return b.Value
+}
+
+// Set implements the flag interface
+func (b *boundedValue) Set(value string) error {
+	old := b.Value.String()
+	if err := b.Value.Set(value); err != nil {
+		return err
+	}
+
+	v, _ := toFloat(b.Value.(flag.Getter).Get())
+	if err := checkBounds(b.name, v, b.min, b.max); err != nil {
+		b.Value.Set(old)
+		return err
+	}
+	return nil
+}
+
+// patternValue wraps a string flag value and validates each value against a
+// regular expression
+type patternValue struct {
+	flag.Value
+	name    string
+	pattern *regexp.Regexp
+}
+
+func (p *patternValue) unwrap() flag.Value {
+	return p.Value
+}
+
+// Set implements the flag interface
+func (p *patternValue) Set(value string) error {
+	if !p.pattern.MatchString(value) {
+		return patternError(p.name, value, p.pattern)
+	}
+	return p.Value.Set(value)
+}
+
+// splitValue wraps a slice flag value and sets each comma separated element
+// of a value. Commas can not be escaped.
+type splitValue struct {
+	flag.Value
+}
+
+func (s *splitValue) unwrap() flag.Value {
+	return s.Value
+}
+
+// IsBoolFlag keeps split slices of booleans usable without a value
+func (s *splitValue) IsBoolFlag() bool {
+	return isBoolValue(s.Value)
+}
+
+// Set implements the flag interface
+func (s *splitValue) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if err := s.Value.Set(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}